@@ -6,16 +6,24 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
 	"substack-outbox/email-service"
-	"substack-outbox/notification-service"
+	"substack-outbox/events"
 	"substack-outbox/google-analytics"
+	"substack-outbox/migration"
+	"substack-outbox/notification-service"
 	"substack-outbox/order-basic"
 	"substack-outbox/order-improved"
+	"substack-outbox/order-saga"
+	"substack-outbox/outbox"
 	"substack-outbox/outbox-worker"
+	"substack-outbox/smtp-sink"
 )
 
 func main() {
@@ -25,14 +33,82 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: go run cmd/main.go <service-name>")
-		fmt.Println("Available services: email-service, notification-service, google-analytics, order-basic, order-improved, email-worker, notification-worker, outbox-worker")
+		fmt.Println("       go run cmd/main.go migrate <up|down|status> [service] [steps]")
+		fmt.Println("Available services: email-service, notification-service, google-analytics, order-basic, order-improved, order-saga, email-worker, notification-worker, outbox-worker, smtp-sink")
 		os.Exit(1)
 	}
 
 	serviceName := os.Args[1]
+	if serviceName == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	viper.SetConfigName("env")
 	viper.SetConfigType("env")
 	viper.AutomaticEnv()
+	viper.SetDefault("EMAIL_WORKER_CRON_PERIOD", 10)
+	viper.SetDefault("EMAIL_WORKER_MAX_ATTEMPTS", 5)
+	viper.SetDefault("EMAIL_WORKER_LEASE_SECONDS", 60)
+	viper.SetDefault("EMAIL_WORKER_FAILURE_RATE", 0)
+	viper.SetDefault("EMAIL_WORKER_BACKOFF_BASE_SECONDS", 5)
+	viper.SetDefault("EMAIL_WORKER_BACKOFF_MULTIPLIER", 2)
+	viper.SetDefault("EMAIL_WORKER_BACKOFF_MAX_SECONDS", 300)
+	viper.SetDefault("EMAIL_WORKER_BACKOFF_JITTER", 0.2)
+	viper.SetDefault("EMAIL_SMTP_PORT", "587")
+	viper.SetDefault("EMAIL_SMTP_TLS", "starttls")
+	viper.SetDefault("EMAIL_SMTP_FROM", "no-reply@example.com")
+	viper.SetDefault("EMAIL_SMTP_TIMEOUT_SECONDS", 30)
+	viper.SetDefault("NOTIFICATION_WORKER_CRON_PERIOD", 10)
+	viper.SetDefault("NOTIFICATION_WORKER_MAX_ATTEMPTS", 5)
+	viper.SetDefault("NOTIFICATION_WORKER_LEASE_SECONDS", 60)
+	viper.SetDefault("NOTIFICATION_WORKER_FAILURE_RATE", 0)
+	viper.SetDefault("NOTIFICATION_WORKER_BACKOFF_BASE_SECONDS", 5)
+	viper.SetDefault("NOTIFICATION_WORKER_BACKOFF_MULTIPLIER", 2)
+	viper.SetDefault("NOTIFICATION_WORKER_BACKOFF_MAX_SECONDS", 300)
+	viper.SetDefault("NOTIFICATION_WORKER_BACKOFF_JITTER", 0.2)
+	viper.SetDefault("SMTP_SINK_ADDR", ":2525")
+	viper.SetDefault("SMTP_SINK_DIR", "./smtp_sink")
+	viper.SetDefault("ORDER_SAGA_FAILURE_RATE", 0.3)
+	viper.SetDefault("ORDER_SAGA_MAX_STEP_ATTEMPTS", 3)
+	viper.SetDefault("ORDER_SAGA_CRON_PERIOD", 1)
+	viper.SetDefault("ORDER_SAGA_STEP_TIMEOUT_SECONDS", 10)
+	viper.SetDefault("ORDER_SAGA_BACKOFF_BASE_SECONDS", 1)
+	viper.SetDefault("ORDER_SAGA_BACKOFF_MULTIPLIER", 2)
+	viper.SetDefault("ORDER_SAGA_BACKOFF_MAX_SECONDS", 30)
+	viper.SetDefault("ORDER_SAGA_BACKOFF_JITTER", 0.2)
+	viper.SetDefault("OUTBOX_WORKER_CRON_PERIOD", 10)
+	viper.SetDefault("OUTBOX_WORKER_BATCH_SIZE", 100)
+	viper.SetDefault("OUTBOX_WORKER_LEASE_SECONDS", 60)
+	viper.SetDefault("OUTBOX_WORKER_MAX_ATTEMPTS", 10)
+	viper.SetDefault("OUTBOX_WORKER_CONCURRENCY", 10)
+	viper.SetDefault("OUTBOX_WORKER_FAILURE_RATE", 0.3)
+	viper.SetDefault("OUTBOX_WORKER_WAKEUP_ADDR", ":8090")
+	viper.SetDefault("OUTBOX_WORKER_RELAY_MODE", "poll")
+	viper.SetDefault("OUTBOX_WORKER_CDC_INTERVAL_MS", 200)
+	viper.SetDefault("OUTBOX_WORKER_CDC_CONSUMER", "outbox-worker")
+	viper.SetDefault("OUTBOX_JANITOR_RETENTION_HOURS", 24)
+	viper.SetDefault("OUTBOX_JANITOR_INTERVAL_SECONDS", 60)
+	viper.SetDefault("OUTBOX_JANITOR_BATCH_SIZE", 500)
+	viper.SetDefault("OUTBOX_JANITOR_ARCHIVE", "table")
+	viper.SetDefault("OUTBOX_JANITOR_ARCHIVE_PATH", "./outbox_archive.ndjson")
+	viper.SetDefault("OUTBOX_RELAY_WAKEUP_URL", "http://localhost:8090/wakeup")
+	viper.SetDefault("OUTBOX_BACKOFF_BASE_SECONDS", 5)
+	viper.SetDefault("OUTBOX_BACKOFF_MULTIPLIER", 2)
+	viper.SetDefault("OUTBOX_BACKOFF_MAX_SECONDS", 300)
+	viper.SetDefault("OUTBOX_BACKOFF_JITTER", 0.2)
+	viper.SetDefault("OUTBOX_HANDLER_TYPES", "EMAIL,NOTIFY,ANALYTIC,"+strings.Join(events.OrderTypes, ","))
+	viper.SetDefault("OUTBOX_HANDLER_EMAIL_URL", "http://localhost:8081/send-email")
+	viper.SetDefault("OUTBOX_HANDLER_NOTIFY_URL", "http://localhost:8082/send-notification")
+	viper.SetDefault("OUTBOX_HANDLER_ANALYTIC_URL", "http://localhost:9000/events")
+	viper.SetDefault("OUTBOX_HANDLER_ANALYTIC_BODY_TEMPLATE", "{{.Envelope}}")
+	for _, messageType := range events.OrderTypes {
+		viper.SetDefault("OUTBOX_HANDLER_"+messageType+"_URL", "http://localhost:9000/events")
+		viper.SetDefault("OUTBOX_HANDLER_"+messageType+"_BODY_TEMPLATE", "{{.Envelope}}")
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -46,26 +122,293 @@ func main() {
 		cancel()
 	}()
 
+	var err error
 	switch serviceName {
 	case "email-service":
-		emailservice.Run(ctx, viper.GetString("EMAIL_SERVICE_PORT"))
+		err = emailservice.Run(ctx, viper.GetString("EMAIL_SERVICE_PORT"))
 	case "notification-service":
-		notificationservice.Run(ctx, viper.GetString("NOTIFICATION_SERVICE_PORT"))
+		err = notificationservice.Run(ctx, viper.GetString("NOTIFICATION_SERVICE_PORT"))
 	case "google-analytics":
-		googleanalytics.Run(ctx, viper.GetString("GOOGLE_ANALYTICS_SERVICE_PORT"))
+		err = googleanalytics.Run(ctx, viper.GetString("GOOGLE_ANALYTICS_SERVICE_PORT"))
 	case "order-basic":
-		orderbasic.Run(ctx, viper.GetString("ORDER_BASIC_SERVICE_PORT"))
+		err = orderbasic.Run(ctx, viper.GetString("ORDER_BASIC_SERVICE_PORT"))
 	case "order-improved":
-		orderimproved.Run(ctx, viper.GetString("ORDER_IMPROVED_SERVICE_PORT"))
+		err = orderimproved.Run(ctx, viper.GetString("ORDER_IMPROVED_SERVICE_PORT"), viper.GetString("OUTBOX_RELAY_WAKEUP_URL"))
+	case "order-saga":
+		err = ordersaga.Run(ctx, ordersaga.Config{
+			Port:            viper.GetString("ORDER_SAGA_SERVICE_PORT"),
+			FailureRate:     viper.GetFloat64("ORDER_SAGA_FAILURE_RATE"),
+			MaxStepAttempts: viper.GetInt("ORDER_SAGA_MAX_STEP_ATTEMPTS"),
+			Backoff:         backoffPolicy("ORDER_SAGA_BACKOFF", outbox.BackoffPolicy{}),
+			PollInterval:    time.Duration(viper.GetInt("ORDER_SAGA_CRON_PERIOD")) * time.Second,
+			StepTimeout:     time.Duration(viper.GetInt("ORDER_SAGA_STEP_TIMEOUT_SECONDS")) * time.Second,
+		})
 	case "email-worker":
-		emailservice.RunWorker(ctx, viper.GetString("EMAIL_WORKER_CRON_PERIOD"))
+		var sender emailservice.Sender = emailservice.LogSender
+		if viper.GetString("EMAIL_SMTP_HOST") != "" {
+			smtpSender, err := emailservice.NewSMTPSender(emailservice.SMTPConfig{
+				Host:     viper.GetString("EMAIL_SMTP_HOST"),
+				Port:     viper.GetString("EMAIL_SMTP_PORT"),
+				Username: viper.GetString("EMAIL_SMTP_USERNAME"),
+				Password: viper.GetString("EMAIL_SMTP_PASSWORD"),
+				TLS:      viper.GetString("EMAIL_SMTP_TLS"),
+				From:     viper.GetString("EMAIL_SMTP_FROM"),
+				Timeout:  time.Duration(viper.GetInt("EMAIL_SMTP_TIMEOUT_SECONDS")) * time.Second,
+			})
+			if err != nil {
+				slog.Error("invalid smtp configuration", "error", err)
+				os.Exit(1)
+			}
+			slog.Info("email worker delivering over smtp", "host", viper.GetString("EMAIL_SMTP_HOST"), "port", viper.GetString("EMAIL_SMTP_PORT"), "tls", viper.GetString("EMAIL_SMTP_TLS"))
+			sender = smtpSender
+		}
+		err = emailservice.RunWorker(ctx, emailservice.WorkerConfig{
+			WorkerID:      viper.GetString("EMAIL_WORKER_ID"),
+			PollInterval:  time.Duration(viper.GetInt("EMAIL_WORKER_CRON_PERIOD")) * time.Second,
+			LeaseDuration: time.Duration(viper.GetInt("EMAIL_WORKER_LEASE_SECONDS")) * time.Second,
+			MaxAttempts:   viper.GetInt("EMAIL_WORKER_MAX_ATTEMPTS"),
+			Backoff:       backoffPolicy("EMAIL_WORKER_BACKOFF", outbox.BackoffPolicy{}),
+			FailureRate:   viper.GetFloat64("EMAIL_WORKER_FAILURE_RATE"),
+			Sender:        sender,
+		})
 	case "notification-worker":
-		notificationservice.RunWorker(ctx, viper.GetString("NOTIFICATION_WORKER_CRON_PERIOD"))
+		err = notificationservice.RunWorker(ctx, notificationservice.WorkerConfig{
+			WorkerID:      viper.GetString("NOTIFICATION_WORKER_ID"),
+			PollInterval:  time.Duration(viper.GetInt("NOTIFICATION_WORKER_CRON_PERIOD")) * time.Second,
+			LeaseDuration: time.Duration(viper.GetInt("NOTIFICATION_WORKER_LEASE_SECONDS")) * time.Second,
+			MaxAttempts:   viper.GetInt("NOTIFICATION_WORKER_MAX_ATTEMPTS"),
+			Backoff:       backoffPolicy("NOTIFICATION_WORKER_BACKOFF", outbox.BackoffPolicy{}),
+			FailureRate:   viper.GetFloat64("NOTIFICATION_WORKER_FAILURE_RATE"),
+			Sender:        notificationservice.LogSender,
+		})
+	case "smtp-sink":
+		err = smtpsink.Run(ctx, smtpsink.Config{
+			Addr: viper.GetString("SMTP_SINK_ADDR"),
+			Dir:  viper.GetString("SMTP_SINK_DIR"),
+		})
 	case "outbox-worker":
-		outboxworker.Run(ctx, viper.GetString("OUTBOX_WORKER_CRON_PERIOD"))
+		messageTypes := splitList(viper.GetString("OUTBOX_HANDLER_TYPES"))
+		if err := registerHTTPHandlers(messageTypes); err != nil {
+			slog.Error("failed to register outbox handlers", "error", err)
+			os.Exit(1)
+		}
+		var archiver outbox.Archiver
+		archiver, err = janitorArchiver(viper.GetString("OUTBOX_JANITOR_ARCHIVE"), viper.GetString("OUTBOX_JANITOR_ARCHIVE_PATH"))
+		if err != nil {
+			slog.Error("invalid outbox janitor configuration", "error", err)
+			os.Exit(1)
+		}
+		defaultBackoff := backoffPolicy("OUTBOX_BACKOFF", outbox.BackoffPolicy{})
+		err = outboxworker.Run(ctx, outboxworker.Config{
+			RelayConfig: outbox.RelayConfig{
+				Mode:            viper.GetString("OUTBOX_WORKER_RELAY_MODE"),
+				CDCInterval:     time.Duration(viper.GetInt("OUTBOX_WORKER_CDC_INTERVAL_MS")) * time.Millisecond,
+				CDCConsumer:     viper.GetString("OUTBOX_WORKER_CDC_CONSUMER"),
+				PollInterval:    time.Duration(viper.GetInt("OUTBOX_WORKER_CRON_PERIOD")) * time.Second,
+				BatchSize:       viper.GetInt("OUTBOX_WORKER_BATCH_SIZE"),
+				LeaseDuration:   time.Duration(viper.GetInt("OUTBOX_WORKER_LEASE_SECONDS")) * time.Second,
+				WorkerID:        viper.GetString("OUTBOX_WORKER_ID"),
+				MaxAttempts:     viper.GetInt("OUTBOX_WORKER_MAX_ATTEMPTS"),
+				Backoff:         defaultBackoff,
+				TypeBackoff:     typeBackoffPolicies(defaultBackoff, messageTypes...),
+				Concurrency:     viper.GetInt("OUTBOX_WORKER_CONCURRENCY"),
+				TypeConcurrency: typeConcurrencyLimits(messageTypes...),
+				Validator:       events.Schemas,
+			},
+			FailureRate: viper.GetFloat64("OUTBOX_WORKER_FAILURE_RATE"),
+			WakeupAddr:  viper.GetString("OUTBOX_WORKER_WAKEUP_ADDR"),
+			Janitor: outbox.JanitorConfig{
+				Retention: time.Duration(viper.GetFloat64("OUTBOX_JANITOR_RETENTION_HOURS") * float64(time.Hour)),
+				Interval:  time.Duration(viper.GetInt("OUTBOX_JANITOR_INTERVAL_SECONDS")) * time.Second,
+				BatchSize: viper.GetInt("OUTBOX_JANITOR_BATCH_SIZE"),
+				Archiver:  archiver,
+			},
+		})
 	default:
 		fmt.Printf("Unknown service: %s\n", serviceName)
-		fmt.Println("Available services: email-service, notification-service, google-analytics, order-basic, order-improved, email-worker, notification-worker, outbox-worker")
+		fmt.Println("Available services: email-service, notification-service, google-analytics, order-basic, order-improved, order-saga, email-worker, notification-worker, outbox-worker, smtp-sink")
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("service failed", "service", serviceName, "error", err)
 		os.Exit(1)
 	}
 }
+
+func janitorArchiver(mode string, path string) (outbox.Archiver, error) {
+	switch mode {
+	case "table":
+		return outbox.TableArchiver{}, nil
+	case "file":
+		return outbox.NewFileArchiver(path), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown archive mode %q, expected table, file or none", mode)
+	}
+}
+
+func backoffPolicy(prefix string, fallback outbox.BackoffPolicy) outbox.BackoffPolicy {
+	policy := fallback
+	if viper.IsSet(prefix + "_BASE_SECONDS") {
+		policy.Base = time.Duration(viper.GetFloat64(prefix+"_BASE_SECONDS") * float64(time.Second))
+	}
+	if viper.IsSet(prefix + "_MULTIPLIER") {
+		policy.Multiplier = viper.GetFloat64(prefix + "_MULTIPLIER")
+	}
+	if viper.IsSet(prefix + "_MAX_SECONDS") {
+		policy.Max = time.Duration(viper.GetFloat64(prefix+"_MAX_SECONDS") * float64(time.Second))
+	}
+	if viper.IsSet(prefix + "_JITTER") {
+		policy.Jitter = viper.GetFloat64(prefix + "_JITTER")
+	}
+	return policy
+}
+
+func typeBackoffPolicies(fallback outbox.BackoffPolicy, messageTypes ...string) map[string]outbox.BackoffPolicy {
+	policies := make(map[string]outbox.BackoffPolicy)
+	for _, messageType := range messageTypes {
+		policies[messageType] = backoffPolicy("OUTBOX_BACKOFF_"+messageType, fallback)
+	}
+	return policies
+}
+
+func typeConcurrencyLimits(messageTypes ...string) map[string]int {
+	limits := make(map[string]int)
+	for _, messageType := range messageTypes {
+		if key := "OUTBOX_WORKER_CONCURRENCY_" + messageType; viper.IsSet(key) {
+			limits[messageType] = viper.GetInt(key)
+		}
+	}
+	return limits
+}
+
+func registerHTTPHandlers(messageTypes []string) error {
+	for _, messageType := range messageTypes {
+		prefix := "OUTBOX_HANDLER_" + messageType
+		handler, err := outbox.NewHTTPHandler(outbox.HTTPHandlerConfig{
+			URL:          viper.GetString(prefix + "_URL"),
+			Method:       viper.GetString(prefix + "_METHOD"),
+			Headers:      parseHeaders(viper.GetString(prefix + "_HEADERS")),
+			BodyTemplate: viper.GetString(prefix + "_BODY_TEMPLATE"),
+			Timeout:      time.Duration(viper.GetInt(prefix+"_TIMEOUT_SECONDS")) * time.Second,
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", messageType, err)
+		}
+		outbox.Register(messageType, handler)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseHeaders(value string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range splitList(value) {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return headers
+}
+
+func migrationSources() []migration.Source {
+	var sources []migration.Source
+	sources = append(sources, emailservice.Migrations()...)
+	sources = append(sources, notificationservice.Migrations()...)
+	sources = append(sources, googleanalytics.Migrations()...)
+	sources = append(sources, orderbasic.Migrations()...)
+	sources = append(sources, orderimproved.Migrations()...)
+	sources = append(sources, ordersaga.Migrations()...)
+	return sources
+}
+
+func runMigrate(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: go run cmd/main.go migrate <up|down|status> [service] [steps]")
+	}
+
+	command := args[0]
+	var sources []migration.Source
+	if len(args) > 1 {
+		for _, source := range migrationSources() {
+			if source.Name == args[1] || (command != "down" && strings.HasPrefix(source.Name, args[1]+"/")) {
+				sources = append(sources, source)
+			}
+		}
+		if len(sources) == 0 {
+			return fmt.Errorf("no migrations for service: %s", args[1])
+		}
+	} else {
+		if command == "down" {
+			return fmt.Errorf("migrate down requires a service name")
+		}
+		sources = migrationSources()
+	}
+
+	steps := 1
+	if len(args) > 2 {
+		parsed, err := strconv.Atoi(args[2])
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("invalid steps: %s", args[2])
+		}
+		steps = parsed
+	}
+
+	for _, source := range sources {
+		if err := migrateSource(command, source, steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSource(command string, source migration.Source, steps int) error {
+	db, err := migration.Open(source.Path)
+	if err != nil {
+		return fmt.Errorf("%s: failed to open database: %w", source.Name, err)
+	}
+	defer db.Close()
+
+	switch command {
+	case "up":
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: applied %d migration(s)\n", source.Name, applied)
+	case "down":
+		reverted, err := migration.Down(db, source, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: reverted %d migration(s)\n", source.Name, reverted)
+	case "status":
+		statuses, err := migration.Statuses(db, source)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s (%s)\n", source.Name, source.Path)
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("  %04d_%s  %s\n", status.Version, status.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", command)
+	}
+	return nil
+}
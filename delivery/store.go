@@ -0,0 +1,218 @@
+package delivery
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"substack-outbox/outbox"
+)
+
+var ErrLeaseLost = errors.New("delivery lease lost")
+
+type Table struct {
+	Records      string
+	Deliveries   string
+	RecordColumn string
+	RecordField  string
+	TargetColumn string
+	TargetField  string
+}
+
+type Delivery struct {
+	ID            int
+	RecordID      int
+	Target        string
+	Status        string
+	Attempts      int
+	LastError     string
+	NextAttemptAt *time.Time
+	CreatedAt     time.Time
+	SentAt        *time.Time
+	FailedAt      *time.Time
+	LockedBy      string
+	LockedUntil   *time.Time
+
+	table *Table
+}
+
+func (d Delivery) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{
+		"id":         d.ID,
+		"status":     d.Status,
+		"attempts":   d.Attempts,
+		"created_at": d.CreatedAt,
+	}
+	fields[d.table.RecordField] = d.RecordID
+	fields[d.table.TargetField] = d.Target
+	if d.LastError != "" {
+		fields["last_error"] = d.LastError
+	}
+	if d.NextAttemptAt != nil {
+		fields["next_attempt_at"] = d.NextAttemptAt
+	}
+	if d.SentAt != nil {
+		fields["sent_at"] = d.SentAt
+	}
+	if d.FailedAt != nil {
+		fields["failed_at"] = d.FailedAt
+	}
+	if d.LockedBy != "" {
+		fields["locked_by"] = d.LockedBy
+	}
+	if d.LockedUntil != nil {
+		fields["locked_until"] = d.LockedUntil
+	}
+	return json.Marshal(fields)
+}
+
+const refreshRecordStatus = `
+	UPDATE %[1]s SET
+		status = CASE
+			WHEN EXISTS (SELECT 1 FROM %[2]s WHERE %[3]s = %[1]s.id AND status IN ('PENDING', 'PROCESSING')) THEN 'PENDING'
+			WHEN NOT EXISTS (SELECT 1 FROM %[2]s WHERE %[3]s = %[1]s.id AND status = 'FAILED') THEN 'SENT'
+			WHEN NOT EXISTS (SELECT 1 FROM %[2]s WHERE %[3]s = %[1]s.id AND status = 'SENT') THEN 'FAILED'
+			ELSE 'PARTIAL'
+		END,
+		attempts = (SELECT COALESCE(SUM(attempts), 0) FROM %[2]s WHERE %[3]s = %[1]s.id),
+		last_error = (SELECT last_error FROM %[2]s WHERE %[3]s = %[1]s.id AND status != 'SENT' AND last_error IS NOT NULL ORDER BY id DESC LIMIT 1),
+		next_attempt_at = (SELECT MIN(next_attempt_at) FROM %[2]s WHERE %[3]s = %[1]s.id AND status IN ('PENDING', 'PROCESSING')),
+		sent_at = (SELECT MAX(sent_at) FROM %[2]s WHERE %[3]s = %[1]s.id AND status = 'SENT'),
+		failed_at = (SELECT MAX(failed_at) FROM %[2]s WHERE %[3]s = %[1]s.id AND status = 'FAILED')
+	WHERE id = ?`
+
+type Store struct {
+	db      *sql.DB
+	table   *Table
+	columns string
+	refresh string
+}
+
+func NewStore(db *sql.DB, table Table) *Store {
+	return &Store{
+		db:      db,
+		table:   &table,
+		columns: "id, " + table.RecordColumn + ", " + table.TargetColumn + ", status, attempts, last_error, next_attempt_at, created_at, sent_at, failed_at, locked_by, locked_until",
+		refresh: fmt.Sprintf(refreshRecordStatus, table.Records, table.Deliveries, table.RecordColumn),
+	}
+}
+
+func (s *Store) Insert(tx *sql.Tx, recordID int64, targets []string) error {
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		if _, err := tx.Exec("INSERT INTO "+s.table.Deliveries+" ("+s.table.RecordColumn+", "+s.table.TargetColumn+") VALUES (?, ?)", recordID, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) List(recordID int) ([]Delivery, error) {
+	return s.query("SELECT "+s.columns+" FROM "+s.table.Deliveries+" WHERE "+s.table.RecordColumn+" = ? ORDER BY id", recordID)
+}
+
+func (s *Store) Claim(workerID string, lease time.Duration) (Delivery, bool, error) {
+	delivery, err := s.scan(s.db.QueryRow(`
+		UPDATE `+s.table.Deliveries+`
+		SET status = 'PROCESSING', locked_by = ?, locked_until = datetime('now', ?)
+		WHERE id = (
+			SELECT id FROM `+s.table.Deliveries+`
+			WHERE (status = 'PENDING' AND (next_attempt_at IS NULL OR next_attempt_at <= CURRENT_TIMESTAMP))
+				OR (status = 'PROCESSING' AND locked_until < CURRENT_TIMESTAMP)
+			ORDER BY id
+			LIMIT 1
+		)
+		RETURNING `+s.columns,
+		workerID, outbox.SecondsModifier(lease),
+	))
+	if err == sql.ErrNoRows {
+		return delivery, false, nil
+	}
+	if err != nil {
+		return delivery, false, err
+	}
+	return delivery, true, nil
+}
+
+func (s *Store) Sent(workerID string, delivery Delivery) error {
+	return s.update(delivery, "UPDATE "+s.table.Deliveries+" SET status = 'SENT', attempts = attempts + 1, next_attempt_at = NULL, sent_at = CURRENT_TIMESTAMP, locked_by = NULL, locked_until = NULL WHERE id = ? AND locked_by = ?", delivery.ID, workerID)
+}
+
+func (s *Store) Fail(workerID string, delivery Delivery, attempts int, cause error) error {
+	return s.update(delivery, "UPDATE "+s.table.Deliveries+" SET status = 'FAILED', attempts = ?, last_error = ?, next_attempt_at = NULL, failed_at = CURRENT_TIMESTAMP, locked_by = NULL, locked_until = NULL WHERE id = ? AND locked_by = ?", attempts, cause.Error(), delivery.ID, workerID)
+}
+
+func (s *Store) Retry(workerID string, delivery Delivery, attempts int, cause error, delay time.Duration) error {
+	return s.update(delivery, "UPDATE "+s.table.Deliveries+" SET status = 'PENDING', attempts = ?, last_error = ?, next_attempt_at = datetime('now', ?), locked_by = NULL, locked_until = NULL WHERE id = ? AND locked_by = ?", attempts, cause.Error(), outbox.SecondsModifier(delay), delivery.ID, workerID)
+}
+
+func (s *Store) query(statement string, args ...interface{}) ([]Delivery, error) {
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		delivery, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *Store) update(delivery Delivery, statement string, args ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(statement, args...)
+	if err != nil {
+		return err
+	}
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return fmt.Errorf("%w: %d", ErrLeaseLost, delivery.ID)
+	}
+	if _, err := tx.Exec(s.refresh, delivery.RecordID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) scan(row interface{ Scan(...interface{}) error }) (Delivery, error) {
+	delivery := Delivery{table: s.table}
+	var lastError, lockedBy sql.NullString
+	var nextAttemptAt, sentAt, failedAt, lockedUntil sql.NullTime
+	err := row.Scan(&delivery.ID, &delivery.RecordID, &delivery.Target, &delivery.Status, &delivery.Attempts, &lastError, &nextAttemptAt, &delivery.CreatedAt, &sentAt, &failedAt, &lockedBy, &lockedUntil)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.LastError = lastError.String
+	if nextAttemptAt.Valid {
+		delivery.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if sentAt.Valid {
+		delivery.SentAt = &sentAt.Time
+	}
+	if failedAt.Valid {
+		delivery.FailedAt = &failedAt.Time
+	}
+	delivery.LockedBy = lockedBy.String
+	if lockedUntil.Valid {
+		delivery.LockedUntil = &lockedUntil.Time
+	}
+	return delivery, nil
+}
@@ -0,0 +1,138 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"time"
+
+	"substack-outbox/outbox"
+)
+
+type Sender interface {
+	Send(ctx context.Context, delivery Delivery) error
+}
+
+type SenderFunc func(ctx context.Context, delivery Delivery) error
+
+func (f SenderFunc) Send(ctx context.Context, delivery Delivery) error {
+	return f(ctx, delivery)
+}
+
+func SimulatedFailures(sender Sender, failureRate float64) Sender {
+	return SenderFunc(func(ctx context.Context, delivery Delivery) error {
+		if rand.Float64() < failureRate {
+			return fmt.Errorf("random failure occurred")
+		}
+		return sender.Send(ctx, delivery)
+	})
+}
+
+type WorkerConfig struct {
+	Name          string
+	WorkerID      string
+	PollInterval  time.Duration
+	LeaseDuration time.Duration
+	MaxAttempts   int
+	Backoff       outbox.BackoffPolicy
+	FailureRate   float64
+}
+
+type Worker struct {
+	store  *Store
+	sender Sender
+	cfg    WorkerConfig
+}
+
+func NewWorker(store *Store, sender Sender, cfg WorkerConfig) *Worker {
+	if cfg.FailureRate > 0 {
+		sender = SimulatedFailures(sender, cfg.FailureRate)
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.WorkerID == "" {
+		cfg.WorkerID = defaultWorkerID(cfg.Name)
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = 60 * time.Second
+	}
+	return &Worker{store: store, sender: sender, cfg: cfg}
+}
+
+func (w *Worker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	slog.Info(w.cfg.Name+" worker started", "worker_id", w.cfg.WorkerID, "poll_interval", w.cfg.PollInterval, "lease", w.cfg.LeaseDuration, "max_attempts", w.cfg.MaxAttempts, "failure_rate", w.cfg.FailureRate)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			w.processDue(ctx)
+		}
+	}
+}
+
+func (w *Worker) processDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		delivery, claimed, err := w.store.Claim(w.cfg.WorkerID, w.cfg.LeaseDuration)
+		if err != nil {
+			slog.Error("failed to claim "+w.cfg.Name+" delivery", "error", err)
+			return
+		}
+		if !claimed {
+			return
+		}
+		w.process(ctx, delivery)
+	}
+}
+
+func (w *Worker) process(ctx context.Context, delivery Delivery) {
+	slog.Info("processing "+w.cfg.Name+" delivery", "id", delivery.ID, "recordId", delivery.RecordID, "attempt", delivery.Attempts+1, "target", delivery.Target)
+
+	sendCtx, cancel := context.WithTimeout(ctx, w.cfg.LeaseDuration/2)
+	err := w.sender.Send(sendCtx, delivery)
+	cancel()
+	if err != nil {
+		w.fail(delivery, err)
+		return
+	}
+
+	if err := w.store.Sent(w.cfg.WorkerID, delivery); err != nil {
+		slog.Error("failed to update "+w.cfg.Name+" delivery status", "id", delivery.ID, "error", err)
+		return
+	}
+	slog.Info(w.cfg.Name+" delivery sent", "id", delivery.ID, "recordId", delivery.RecordID, "target", delivery.Target, "attempts", delivery.Attempts+1)
+}
+
+func (w *Worker) fail(delivery Delivery, cause error) {
+	attempts := delivery.Attempts + 1
+	if outbox.IsPermanent(cause) || attempts >= w.cfg.MaxAttempts {
+		if err := w.store.Fail(w.cfg.WorkerID, delivery, attempts, cause); err != nil {
+			slog.Error("failed to mark "+w.cfg.Name+" delivery as failed", "id", delivery.ID, "error", err)
+			return
+		}
+		slog.Error(w.cfg.Name+" delivery moved to FAILED", "id", delivery.ID, "recordId", delivery.RecordID, "target", delivery.Target, "attempts", attempts, "permanent", outbox.IsPermanent(cause), "error", cause)
+		return
+	}
+
+	delay := w.cfg.Backoff.Delay(attempts)
+	if err := w.store.Retry(w.cfg.WorkerID, delivery, attempts, cause, delay); err != nil {
+		slog.Error("failed to schedule "+w.cfg.Name+" delivery retry", "id", delivery.ID, "error", err)
+		return
+	}
+	slog.Error("failed to send "+w.cfg.Name+" delivery, scheduled for retry", "id", delivery.ID, "recordId", delivery.RecordID, "target", delivery.Target, "attempts", attempts, "backoff", delay.Round(time.Millisecond), "error", cause)
+}
+
+func defaultWorkerID(name string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = name + "-worker"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
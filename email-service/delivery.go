@@ -0,0 +1,14 @@
+package emailservice
+
+import "substack-outbox/delivery"
+
+type EmailDelivery = delivery.Delivery
+
+var emailDeliveryTable = delivery.Table{
+	Records:      "emails",
+	Deliveries:   "email_deliveries",
+	RecordColumn: "email_id",
+	RecordField:  "emailId",
+	TargetColumn: "recipient",
+	TargetField:  "recipient",
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS emails (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	recipients TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at DATETIME
+);
@@ -0,0 +1 @@
+ALTER TABLE emails ADD COLUMN html_body TEXT;
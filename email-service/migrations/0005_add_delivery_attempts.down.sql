@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_emails_status_next_attempt;
+
+ALTER TABLE emails DROP COLUMN failed_at;
+ALTER TABLE emails DROP COLUMN next_attempt_at;
+ALTER TABLE emails DROP COLUMN last_error;
+ALTER TABLE emails DROP COLUMN attempts;
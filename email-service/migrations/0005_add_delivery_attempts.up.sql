@@ -0,0 +1,6 @@
+ALTER TABLE emails ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE emails ADD COLUMN last_error TEXT;
+ALTER TABLE emails ADD COLUMN next_attempt_at DATETIME;
+ALTER TABLE emails ADD COLUMN failed_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_emails_status_next_attempt ON emails (status, next_attempt_at);
@@ -0,0 +1,5 @@
+UPDATE emails SET status = 'FAILED' WHERE status = 'PARTIAL';
+
+DROP INDEX IF EXISTS idx_email_deliveries_status_next_attempt;
+DROP INDEX IF EXISTS idx_email_deliveries_email_id_recipient;
+DROP TABLE IF EXISTS email_deliveries;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS email_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email_id INTEGER NOT NULL REFERENCES emails(id),
+	recipient TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at DATETIME,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at DATETIME,
+	failed_at DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_email_deliveries_email_id_recipient ON email_deliveries (email_id, recipient);
+CREATE INDEX IF NOT EXISTS idx_email_deliveries_status_next_attempt ON email_deliveries (status, next_attempt_at);
+
+INSERT INTO email_deliveries (email_id, recipient, status, attempts, last_error, next_attempt_at, created_at, sent_at, failed_at)
+SELECT DISTINCT emails.id, target.value, emails.status, emails.attempts, emails.last_error, emails.next_attempt_at, emails.created_at, emails.sent_at, emails.failed_at
+FROM emails, json_each(emails.recipients) AS target;
@@ -0,0 +1,3 @@
+UPDATE email_deliveries SET status = 'PENDING' WHERE status = 'PROCESSING';
+ALTER TABLE email_deliveries DROP COLUMN locked_until;
+ALTER TABLE email_deliveries DROP COLUMN locked_by;
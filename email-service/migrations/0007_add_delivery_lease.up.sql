@@ -0,0 +1,2 @@
+ALTER TABLE email_deliveries ADD COLUMN locked_by TEXT;
+ALTER TABLE email_deliveries ADD COLUMN locked_until DATETIME;
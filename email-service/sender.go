@@ -0,0 +1,21 @@
+package emailservice
+
+import (
+	"context"
+	"log/slog"
+)
+
+type Sender interface {
+	Send(ctx context.Context, email EmailRecord, delivery EmailDelivery) error
+}
+
+type SenderFunc func(ctx context.Context, email EmailRecord, delivery EmailDelivery) error
+
+func (f SenderFunc) Send(ctx context.Context, email EmailRecord, delivery EmailDelivery) error {
+	return f(ctx, email, delivery)
+}
+
+var LogSender = SenderFunc(func(ctx context.Context, email EmailRecord, delivery EmailDelivery) error {
+	slog.Info("email delivered to log", "id", email.ID, "deliveryId", delivery.ID, "recipient", delivery.Target, "subject", email.Subject, "body", email.Body)
+	return nil
+})
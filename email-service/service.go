@@ -3,6 +3,7 @@ package emailservice
 import (
 	"context"
 	"database/sql"
+	"embed"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -11,57 +12,92 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
-	_ "github.com/mattn/go-sqlite3"
+	"substack-outbox/delivery"
+	"substack-outbox/idempotency"
+	"substack-outbox/inbox"
+	"substack-outbox/listing"
+	"substack-outbox/migration"
+	"substack-outbox/outbox"
 )
 
 type EmailRequest struct {
 	Recipients []string `json:"recipients"`
 	Subject    string   `json:"subject"`
 	Body       string   `json:"body"`
+	HTMLBody   string   `json:"htmlBody,omitempty"`
 }
 
 type EmailRecord struct {
-	ID         int        `json:"id"`
-	Recipients string     `json:"recipients"`
-	Subject    string     `json:"subject"`
-	Body       string     `json:"body"`
-	Status     string     `json:"status"`
-	CreatedAt  time.Time  `json:"created_at"`
-	SentAt     *time.Time `json:"sent_at,omitempty"`
+	ID            int             `json:"id"`
+	Recipients    string          `json:"recipients"`
+	Subject       string          `json:"subject"`
+	Body          string          `json:"body"`
+	HTMLBody      string          `json:"htmlBody,omitempty"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+	FailedAt      *time.Time      `json:"failed_at,omitempty"`
+	Deliveries    []EmailDelivery `json:"deliveries,omitempty"`
 }
 
+type WorkerConfig struct {
+	WorkerID      string
+	PollInterval  time.Duration
+	LeaseDuration time.Duration
+	MaxAttempts   int
+	Backoff       outbox.BackoffPolicy
+	FailureRate   float64
+	Sender        Sender
+}
+
+const databasePath = "./email_service.db"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
 var db *sql.DB
 
-func initDB() error {
-	var err error
-	db, err = sql.Open("sqlite3", "./email_service.db")
-	if err != nil {
-		return err
-	}
+var messageInbox *inbox.Inbox
 
-	_, err = db.Exec("PRAGMA journal_mode=WAL")
-	if err != nil {
-		return err
+var deliveryStore *delivery.Store
+
+const emailColumns = "id, recipients, subject, body, html_body, status, attempts, last_error, next_attempt_at, created_at, sent_at, failed_at"
+
+var emailListing = listing.Spec{
+	Sorts:      []string{"created_at"},
+	Filters:    map[string]string{"status": "status"},
+	TimeColumn: "created_at",
+}
+
+func Migrations() []migration.Source {
+	return []migration.Source{
+		{Name: "email-service", Path: databasePath, FS: migrationFiles, Dir: "migrations"},
 	}
+}
 
-	_, err = db.Exec("PRAGMA busy_timeout=5000")
+func initDB() error {
+	var err error
+	db, err = migration.Open(databasePath)
 	if err != nil {
 		return err
 	}
 
-	createTable := `
-	CREATE TABLE IF NOT EXISTS emails (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		recipients TEXT NOT NULL,
-		subject TEXT NOT NULL,
-		body TEXT NOT NULL,
-		status TEXT NOT NULL DEFAULT 'PENDING',
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		sent_at DATETIME
-	);`
+	for _, source := range Migrations() {
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			slog.Info("database migrated", "source", source.Name, "applied", applied)
+		}
+	}
 
-	_, err = db.Exec(createTable)
-	return err
+	deliveryStore = delivery.NewStore(db, emailDeliveryTable)
+	messageInbox = inbox.New(db, "email_id", "emailId")
+	return nil
 }
 
 func Run(ctx context.Context, port string) error {
@@ -73,6 +109,9 @@ func Run(ctx context.Context, port string) error {
 	e := echo.New()
 	e.POST("/send-email", handleSendEmail)
 	e.GET("/emails", handleGetEmails)
+	e.GET("/emails/:id", handleGetEmail)
+	e.GET("/inbox", messageInbox.HandleList)
+	e.GET("/inbox/:messageId", messageInbox.HandleGet)
 
 	server := &http.Server{
 		Addr:    ":" + port,
@@ -96,99 +135,200 @@ func handleSendEmail(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
+	if len(req.Recipients) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "at least one recipient is required"})
+	}
+
+	messageID := c.Request().Header.Get(inbox.MessageIDHeader)
+	if messageID != "" {
+		duplicate, err := messageInbox.AcknowledgeDuplicate(c, messageID)
+		if err != nil {
+			slog.Error("failed to look up inbox message", "messageId", messageID, "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up inbox message"})
+		}
+		if duplicate {
+			slog.Info("duplicate email message acknowledged", "messageId", messageID)
+			return nil
+		}
+	}
+
+	idempotencyKey := c.Request().Header.Get(idempotency.Header)
+	if idempotencyKey != "" {
+		replayed, err := idempotency.Replay(c, db, idempotencyKey)
+		if err != nil {
+			slog.Error("failed to look up idempotency key", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up idempotency key"})
+		}
+		if replayed {
+			slog.Info("duplicate email request ignored", "idempotencyKey", idempotencyKey)
+			return nil
+		}
+	}
 
 	recipientsJSON, _ := json.Marshal(req.Recipients)
 
-	_, err := db.Exec(
-		"INSERT INTO emails (recipients, subject, body, status) VALUES (?, ?, ?, ?)",
-		string(recipientsJSON), req.Subject, req.Body, "PENDING",
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO emails (recipients, subject, body, html_body, status) VALUES (?, ?, ?, ?, ?)",
+		string(recipientsJSON), req.Subject, req.Body, sql.NullString{String: req.HTMLBody, Valid: req.HTMLBody != ""}, "PENDING",
 	)
 	if err != nil {
 		slog.Error("failed to insert email", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store email"})
 	}
+	id, _ := result.LastInsertId()
+
+	if err := deliveryStore.Insert(tx, id, req.Recipients); err != nil {
+		slog.Error("failed to insert email deliveries", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store email"})
+	}
 
-	slog.Info("email stored", "recipients", req.Recipients, "subject", req.Subject)
-	return c.JSON(http.StatusOK, map[string]string{"status": "email stored successfully"})
+	response := map[string]interface{}{"status": "email stored successfully", "id": id}
+	if messageID != "" {
+		if err := messageInbox.Record(tx, messageID, c.Request().Header.Get(inbox.MessageTypeHeader), id); err != nil {
+			if idempotency.IsUniqueViolation(err) {
+				tx.Rollback()
+				_, err = messageInbox.AcknowledgeDuplicate(c, messageID)
+				return err
+			}
+			slog.Error("failed to record inbox message", "messageId", messageID, "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store email"})
+		}
+	}
+	if idempotencyKey != "" {
+		if err := idempotency.Save(tx, idempotencyKey, http.StatusOK, response); err != nil {
+			if idempotency.IsUniqueViolation(err) {
+				tx.Rollback()
+				_, err = idempotency.Replay(c, db, idempotencyKey)
+				return err
+			}
+			slog.Error("failed to store idempotency key", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store email"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit email", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store email"})
+	}
+
+	slog.Info("email stored", "id", id, "messageId", messageID, "schemaVersion", c.Request().Header.Get("X-Schema-Version"), "recipients", req.Recipients, "subject", req.Subject)
+	return c.JSON(http.StatusOK, response)
 }
 
 func handleGetEmails(c echo.Context) error {
-	rows, err := db.Query("SELECT id, recipients, subject, body, status, created_at, sent_at FROM emails ORDER BY created_at DESC")
+	query, err := listing.Parse(c.QueryParams(), emailListing)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	statement, args := query.SQL("emails", emailColumns)
+	rows, err := db.Query(statement, args...)
 	if err != nil {
+		slog.Error("failed to fetch emails", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch emails"})
 	}
 	defer rows.Close()
 
-	var emails []EmailRecord
+	emails := []EmailRecord{}
+	page := query.Page()
 	for rows.Next() {
-		var email EmailRecord
-		var sentAt sql.NullTime
-		err := rows.Scan(&email.ID, &email.Recipients, &email.Subject, &email.Body, &email.Status, &email.CreatedAt, &sentAt)
+		var key string
+		email, err := scanEmail(rows, &key)
 		if err != nil {
-			continue
+			slog.Error("failed to scan email", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read emails"})
 		}
-		if sentAt.Valid {
-			email.SentAt = &sentAt.Time
+		if !page.Add(key, email.ID) {
+			break
 		}
 		emails = append(emails, email)
 	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read emails", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read emails"})
+	}
 
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
 	return c.JSON(http.StatusOK, emails)
 }
 
-func RunWorker(ctx context.Context, cronPeriod string) error {
-	if err := initDB(); err != nil {
-		return fmt.Errorf("failed to init database: %w", err)
+func handleGetEmail(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid email id"})
 	}
-	defer db.Close()
 
-	cronPeriodInt, _ := strconv.Atoi(cronPeriod)
-	ticker := time.NewTicker(time.Duration(cronPeriodInt) * time.Second)
-	defer ticker.Stop()
-
-	slog.Info("email worker started", "cron_period", cronPeriod)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			processPendingEmails()
-		}
+	email, err := scanEmail(db.QueryRow("SELECT "+emailColumns+" FROM emails WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "email not found"})
 	}
-}
-
-func processPendingEmails() {
-	slog.Info("processing pending emails")
-
-	countQuery := "SELECT COUNT(*) FROM emails WHERE status = 'PENDING'"
-	var count int
-	err := db.QueryRow(countQuery).Scan(&count)
 	if err != nil {
-		slog.Error("failed to count pending emails", "error", err)
-		return
+		slog.Error("failed to fetch email", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch email"})
 	}
-	slog.Info("found pending emails", "count", count)
 
-	rows, err := db.Query("SELECT id, recipients, subject, body FROM emails WHERE status = 'PENDING'")
+	email.Deliveries, err = deliveryStore.List(id)
 	if err != nil {
-		slog.Error("failed to query pending emails", "error", err)
-		return
+		slog.Error("failed to fetch email deliveries", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch email"})
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var email EmailRecord
-		err := rows.Scan(&email.ID, &email.Recipients, &email.Subject, &email.Body)
-		if err != nil {
-			continue
-		}
+	return c.JSON(http.StatusOK, email)
+}
+
+func scanEmail(row interface{ Scan(...interface{}) error }, extra ...interface{}) (EmailRecord, error) {
+	var email EmailRecord
+	var htmlBody, lastError sql.NullString
+	var nextAttemptAt, sentAt, failedAt sql.NullTime
+	dest := []interface{}{&email.ID, &email.Recipients, &email.Subject, &email.Body, &htmlBody, &email.Status, &email.Attempts, &lastError, &nextAttemptAt, &email.CreatedAt, &sentAt, &failedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return email, err
+	}
+	email.HTMLBody = htmlBody.String
+	email.LastError = lastError.String
+	if nextAttemptAt.Valid {
+		email.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if sentAt.Valid {
+		email.SentAt = &sentAt.Time
+	}
+	if failedAt.Valid {
+		email.FailedAt = &failedAt.Time
+	}
+	return email, nil
+}
+
+func RunWorker(ctx context.Context, cfg WorkerConfig) error {
+	if err := initDB(); err != nil {
+		return fmt.Errorf("failed to init database: %w", err)
+	}
+	defer db.Close()
 
-		slog.Info("processing email", "id", email.ID, "recipients", email.Recipients, "subject", email.Subject, "body", email.Body)
+	sender := cfg.Sender
+	if sender == nil {
+		sender = LogSender
+	}
 
-		_, err = db.Exec("UPDATE emails SET status = 'SENT', sent_at = CURRENT_TIMESTAMP WHERE id = ?", email.ID)
+	worker := delivery.NewWorker(deliveryStore, delivery.SenderFunc(func(ctx context.Context, delivery EmailDelivery) error {
+		email, err := scanEmail(db.QueryRow("SELECT "+emailColumns+" FROM emails WHERE id = ?", delivery.RecordID))
 		if err != nil {
-			slog.Error("failed to update email status", "id", email.ID, "error", err)
+			return fmt.Errorf("failed to fetch email of delivery: %w", err)
 		}
-	}
+		return sender.Send(ctx, email, delivery)
+	}), delivery.WorkerConfig{
+		Name:          "email",
+		WorkerID:      cfg.WorkerID,
+		PollInterval:  cfg.PollInterval,
+		LeaseDuration: cfg.LeaseDuration,
+		MaxAttempts:   cfg.MaxAttempts,
+		Backoff:       cfg.Backoff,
+		FailureRate:   cfg.FailureRate,
+	})
+	return worker.Run(ctx)
 }
@@ -0,0 +1,208 @@
+package emailservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"substack-outbox/outbox"
+)
+
+const (
+	SMTPTLSNone     = "none"
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+)
+
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	TLS      string
+	From     string
+	Timeout  time.Duration
+}
+
+type smtpSender struct {
+	config SMTPConfig
+	from   *mail.Address
+}
+
+func NewSMTPSender(config SMTPConfig) (Sender, error) {
+	switch config.TLS {
+	case "":
+		config.TLS = SMTPTLSNone
+	case SMTPTLSNone, SMTPTLSStartTLS, SMTPTLSImplicit:
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q, expected none, starttls or tls", config.TLS)
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP from-address %q: %w", config.From, err)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	return &smtpSender{config: config, from: from}, nil
+}
+
+func (s *smtpSender) Send(ctx context.Context, email EmailRecord, delivery EmailDelivery) error {
+	recipient, err := mail.ParseAddress(delivery.Target)
+	if err != nil {
+		return outbox.Permanent(fmt.Errorf("invalid recipient %q: %w", delivery.Target, err))
+	}
+
+	message, err := s.compose(email, delivery, recipient)
+	if err != nil {
+		return outbox.Permanent(fmt.Errorf("failed to compose email: %w", err))
+	}
+
+	client, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if s.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)); err != nil {
+			return smtpFailure(err, "smtp auth failed")
+		}
+	}
+	if err := client.Mail(s.from.Address); err != nil {
+		return smtpFailure(err, "smtp MAIL FROM rejected")
+	}
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return smtpFailure(err, "smtp RCPT TO "+recipient.Address+" rejected")
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return smtpFailure(err, "smtp DATA rejected")
+	}
+	if _, err := writer.Write(message); err != nil {
+		return fmt.Errorf("failed to write email data: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return smtpFailure(err, "smtp server rejected email")
+	}
+	if err := client.Quit(); err != nil {
+		slog.Warn("smtp QUIT failed after the email was accepted", "email_id", email.ID, "recipient", recipient.Address, "error", err)
+	}
+	return nil
+}
+
+func smtpFailure(err error, message string) error {
+	err = fmt.Errorf("%s: %w", message, err)
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return outbox.Permanent(err)
+	}
+	return err
+}
+
+func (s *smtpSender) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(s.config.Host, s.config.Port)
+	dialer := &net.Dialer{Timeout: s.config.Timeout}
+	tlsConfig := &tls.Config{ServerName: s.config.Host}
+
+	var conn net.Conn
+	var err error
+	if s.config.TLS == SMTPTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to smtp server %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(s.config.Timeout))
+
+	client, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to greet smtp server %s: %w", addr, err)
+	}
+	if s.config.TLS == SMTPTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("smtp STARTTLS failed: %w", err)
+		}
+	}
+	return client, nil
+}
+
+func (s *smtpSender) compose(email EmailRecord, delivery EmailDelivery, recipient *mail.Address) ([]byte, error) {
+	var message bytes.Buffer
+	body := multipart.NewWriter(&message)
+
+	domain := s.from.Address[strings.LastIndex(s.from.Address, "@")+1:]
+
+	headers := []string{
+		"From: " + s.from.String(),
+		"To: " + recipient.String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", email.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <email-%d-%d-%d@%s>", email.ID, delivery.ID, email.CreatedAt.Unix(), domain),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	message.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	htmlBody := email.HTMLBody
+	if htmlBody == "" {
+		htmlBody = plainTextToHTML(email.Body)
+	}
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", email.Body},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		writer, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+func plainTextToHTML(text string) string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			paragraphs = append(paragraphs, "<p>"+strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>")+"</p>")
+		}
+	}
+	return "<!DOCTYPE html><html><body>" + strings.Join(paragraphs, "") + "</body></html>"
+}
@@ -0,0 +1,89 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	TypeEmail    = "EMAIL"
+	TypeNotify   = "NOTIFY"
+	TypeAnalytic = "ANALYTIC"
+)
+
+const (
+	TypeOrderCreated   = "ORDER_CREATED"
+	TypeOrderPaid      = "ORDER_PAID"
+	TypeOrderFinished  = "ORDER_FINISHED"
+	TypeOrderCancelled = "ORDER_CANCELLED"
+	TypeOrderRefunded  = "ORDER_REFUNDED"
+)
+
+var OrderTypes = []string{TypeOrderCreated, TypeOrderPaid, TypeOrderFinished, TypeOrderCancelled, TypeOrderRefunded}
+
+type Payload interface {
+	MessageType() string
+	SchemaVersion() int
+	Validate() error
+}
+
+type Email struct {
+	Recipients []string `json:"recipients"`
+	Subject    string   `json:"subject"`
+	Body       string   `json:"body"`
+}
+
+func (Email) MessageType() string { return TypeEmail }
+
+func (Email) SchemaVersion() int { return 1 }
+
+func (e Email) Validate() error { return validate(e) }
+
+type Notify struct {
+	DeviceID []string `json:"deviceId"`
+	Message  string   `json:"message"`
+}
+
+func (Notify) MessageType() string { return TypeNotify }
+
+func (Notify) SchemaVersion() int { return 1 }
+
+func (n Notify) Validate() error { return validate(n) }
+
+type Analytic struct {
+	Event     string    `json:"event"`
+	OrderID   string    `json:"orderId"`
+	UserEmail string    `json:"userEmail,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitzero"`
+}
+
+func (Analytic) MessageType() string { return TypeAnalytic }
+
+func (Analytic) SchemaVersion() int { return 1 }
+
+func (a Analytic) Validate() error { return validate(a) }
+
+type OrderStatusChanged struct {
+	OrderID    string    `json:"orderId"`
+	Action     string    `json:"action,omitempty"`
+	FromStatus string    `json:"fromStatus,omitempty"`
+	Status     string    `json:"status"`
+	ChangedAt  time.Time `json:"changedAt,omitzero"`
+}
+
+func OrderEventType(status string) string { return "ORDER_" + status }
+
+func (o OrderStatusChanged) MessageType() string { return OrderEventType(o.Status) }
+
+func (OrderStatusChanged) SchemaVersion() int { return 1 }
+
+func (o OrderStatusChanged) Validate() error { return validate(o) }
+
+func validate(payload Payload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("invalid %s payload: %w", payload.MessageType(), err)
+	}
+	return Schemas.Validate(payload.MessageType(), payload.SchemaVersion(), data)
+}
@@ -0,0 +1,331 @@
+package events
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+var schemaFileName = regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\.v([0-9]+)\.json$`)
+
+var supportedKeywords = map[string]bool{
+	"$schema": true, "$id": true, "title": true, "description": true,
+	"type": true, "properties": true, "required": true, "additionalProperties": true, "items": true,
+	"minItems": true, "minLength": true, "pattern": true, "format": true, "enum": true,
+}
+
+type Schema struct {
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MinLength            *int               `json:"minLength"`
+	Pattern              string             `json:"pattern"`
+	Format               string             `json:"format"`
+	Enum                 []interface{}      `json:"enum"`
+
+	pattern *regexp.Regexp
+}
+
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]map[int]*Schema
+}
+
+var Schemas = mustLoadSchemas(schemaFiles, "schemas")
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: make(map[string]map[int]*Schema)}
+}
+
+func LoadSchemas(fsys fs.FS, dir string) (*SchemaRegistry, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := NewSchemaRegistry()
+	for _, entry := range entries {
+		match := schemaFileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema version in %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKeywords("$", content); err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", entry.Name(), err)
+		}
+		var schema Schema
+		if err := json.Unmarshal(content, &schema); err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", entry.Name(), err)
+		}
+		if err := registry.Register(match[1], version, &schema); err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", entry.Name(), err)
+		}
+	}
+	return registry, nil
+}
+
+func checkKeywords(at string, content json.RawMessage) error {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(content, &keywords); err != nil {
+		return fmt.Errorf("%s: %w", at, err)
+	}
+
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !supportedKeywords[name] {
+			return fmt.Errorf("%s: unsupported keyword %q", at, name)
+		}
+	}
+
+	if items, ok := keywords["items"]; ok {
+		if err := checkKeywords(at+".items", items); err != nil {
+			return err
+		}
+	}
+	if raw, ok := keywords["properties"]; ok {
+		var properties map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &properties); err != nil {
+			return fmt.Errorf("%s.properties: %w", at, err)
+		}
+		for name, property := range properties {
+			if err := checkKeywords(at+".properties."+name, property); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mustLoadSchemas(fsys fs.FS, dir string) *SchemaRegistry {
+	registry, err := LoadSchemas(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+func (r *SchemaRegistry) Register(messageType string, version int, schema *Schema) error {
+	if err := schema.compile(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schemas[messageType] == nil {
+		r.schemas[messageType] = make(map[int]*Schema)
+	}
+	r.schemas[messageType][version] = schema
+	return nil
+}
+
+func (r *SchemaRegistry) Lookup(messageType string, version int) (*Schema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schema, ok := r.schemas[messageType][version]
+	return schema, ok
+}
+
+func (r *SchemaRegistry) Versions(messageType string) []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions := make([]int, 0, len(r.schemas[messageType]))
+	for version := range r.schemas[messageType] {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+func (r *SchemaRegistry) Validate(messageType string, version int, data []byte) error {
+	versions := r.Versions(messageType)
+	if len(versions) == 0 {
+		return fmt.Errorf("no schema registered for %s", messageType)
+	}
+
+	schema, ok := r.Lookup(messageType, version)
+	if !ok {
+		return fmt.Errorf("no schema registered for %s v%d (known versions: %v)", messageType, version, versions)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("%s v%d payload is not valid json: %w", messageType, version, err)
+	}
+
+	var problems []string
+	schema.validate("$", value, &problems)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s v%d payload does not match schema: %s", messageType, version, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (s *Schema) compile() error {
+	switch s.Type {
+	case "", "object", "array", "string", "boolean", "number", "integer", "null":
+	default:
+		return fmt.Errorf("unsupported type %q", s.Type)
+	}
+	switch s.Format {
+	case "", "email", "date-time":
+	default:
+		return fmt.Errorf("unsupported format %q", s.Format)
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for name, property := range s.Properties {
+		if err := property.compile(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+func (s *Schema) validate(at string, value interface{}, problems *[]string) {
+	report := func(format string, args ...interface{}) {
+		*problems = append(*problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.Type != "" && !hasType(value, s.Type) {
+		report("must be %s", s.Type)
+		return
+	}
+	if len(s.Enum) > 0 && !inEnum(value, s.Enum) {
+		report("must be one of %v", s.Enum)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				report("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					report("unexpected property %q", name)
+				}
+				continue
+			}
+			property.validate(at+"."+name, v[name], problems)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			report("must have at least %d item(s)", *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", at, i), item, problems)
+			}
+		}
+	case string:
+		if s.MinLength != nil && len([]rune(v)) < *s.MinLength {
+			report("must be at least %d character(s)", *s.MinLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			report("must match pattern %q", s.Pattern)
+		}
+		if err := checkFormat(s.Format, v); err != nil {
+			report("%v", err)
+		}
+	}
+}
+
+func hasType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := number.Int64()
+		return err == nil
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkFormat(format string, value string) error {
+	switch format {
+	case "email":
+		at := strings.LastIndex(value, "@")
+		if at <= 0 || at == len(value)-1 {
+			return errors.New("must be an email address")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			return errors.New("must be an RFC 3339 date-time")
+		}
+	}
+	return nil
+}
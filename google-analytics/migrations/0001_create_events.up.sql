@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id TEXT,
+	type TEXT,
+	schema_version INTEGER,
+	correlation_id TEXT,
+	order_id TEXT,
+	payload TEXT NOT NULL,
+	received_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -2,19 +2,65 @@ package googleanalytics
 
 import (
 	"context"
+	"database/sql"
+	"embed"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"substack-outbox/idempotency"
+	"substack-outbox/migration"
 )
 
 type AnalyticsEvent struct {
-	Payload json.RawMessage `json:"payload"`
+	MessageID     string          `json:"messageId"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schemaVersion"`
+	CorrelationID string          `json:"correlationId"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+const databasePath = "./google_analytics.db"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var db *sql.DB
+
+func Migrations() []migration.Source {
+	return []migration.Source{
+		{Name: "google-analytics", Path: databasePath, FS: migrationFiles, Dir: "migrations"},
+	}
+}
+
+func initDB() error {
+	var err error
+	db, err = migration.Open(databasePath)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range Migrations() {
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			slog.Info("database migrated", "source", source.Name, "applied", applied)
+		}
+	}
+	return nil
 }
 
 func Run(ctx context.Context, port string) error {
+	if err := initDB(); err != nil {
+		return fmt.Errorf("failed to init database: %w", err)
+	}
+	defer db.Close()
+
 	e := echo.New()
 	e.POST("/events", handleAnalyticsEvent)
 
@@ -49,6 +95,53 @@ func handleAnalyticsEvent(c echo.Context) error {
 		}
 	}
 
-	slog.Info("analytics event received", "orderId", orderID, "payload", string(event.Payload), "timestamp", time.Now())
-	return c.JSON(http.StatusOK, map[string]string{"status": "event processed successfully"})
+	idempotencyKey := c.Request().Header.Get(idempotency.Header)
+	if idempotencyKey != "" {
+		replayed, err := idempotency.Replay(c, db, idempotencyKey)
+		if err != nil {
+			slog.Error("failed to look up idempotency key", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up idempotency key"})
+		}
+		if replayed {
+			slog.Info("duplicate analytics event ignored", "orderId", orderID, "idempotencyKey", idempotencyKey)
+			return nil
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	var eventID int64
+	err = tx.QueryRow(
+		"INSERT INTO events (message_id, type, schema_version, correlation_id, order_id, payload) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		event.MessageID, event.Type, event.SchemaVersion, event.CorrelationID, orderID, string(event.Payload),
+	).Scan(&eventID)
+	if err != nil {
+		slog.Error("failed to store analytics event", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store event"})
+	}
+
+	response := map[string]interface{}{"status": "event processed successfully", "eventId": eventID}
+	if idempotencyKey != "" {
+		if err := idempotency.Save(tx, idempotencyKey, http.StatusOK, response); err != nil {
+			if idempotency.IsUniqueViolation(err) {
+				tx.Rollback()
+				_, err = idempotency.Replay(c, db, idempotencyKey)
+				return err
+			}
+			slog.Error("failed to store idempotency key", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store event"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit analytics event", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store event"})
+	}
+
+	slog.Info("analytics event received", "eventId", eventID, "messageId", event.MessageID, "schemaVersion", event.SchemaVersion, "correlationId", event.CorrelationID, "orderId", orderID, "payload", string(event.Payload), "timestamp", time.Now())
+	return c.JSON(http.StatusOK, response)
 }
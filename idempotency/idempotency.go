@@ -0,0 +1,48 @@
+package idempotency
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+)
+
+func Replay(c echo.Context, db *sql.DB, key string) (bool, error) {
+	var statusCode int
+	var response string
+	err := db.QueryRow("SELECT status_code, response FROM idempotency_keys WHERE key = ?", key).Scan(&statusCode, &response)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.Response().Header().Set(ReplayedHeader, "true")
+	return true, c.JSONBlob(statusCode, []byte(response))
+}
+
+func Save(tx *sql.Tx, key string, statusCode int, response interface{}) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO idempotency_keys (key, status_code, response) VALUES (?, ?, ?)", key, statusCode, string(body))
+	return err
+}
+
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
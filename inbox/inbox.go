@@ -0,0 +1,145 @@
+package inbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"substack-outbox/listing"
+)
+
+const (
+	MessageIDHeader   = "X-Message-Id"
+	MessageTypeHeader = "X-Message-Type"
+	DuplicateHeader   = "Inbox-Duplicate"
+)
+
+type Message struct {
+	ID              int
+	MessageID       string
+	MessageType     string
+	RecordID        int
+	Deliveries      int
+	ReceivedAt      time.Time
+	LastDeliveredAt time.Time
+
+	recordField string
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":                m.ID,
+		"messageId":         m.MessageID,
+		"messageType":       m.MessageType,
+		m.recordField:       m.RecordID,
+		"deliveries":        m.Deliveries,
+		"received_at":       m.ReceivedAt,
+		"last_delivered_at": m.LastDeliveredAt,
+	})
+}
+
+type Inbox struct {
+	db          *sql.DB
+	column      string
+	recordField string
+	columns     string
+	listing     listing.Spec
+}
+
+func New(db *sql.DB, column string, recordField string) *Inbox {
+	return &Inbox{
+		db:          db,
+		column:      column,
+		recordField: recordField,
+		columns:     "id, message_id, message_type, " + column + ", deliveries, received_at, last_delivered_at",
+		listing: listing.Spec{
+			Sorts:      []string{"received_at", "last_delivered_at", "deliveries"},
+			Filters:    map[string]string{"messageType": "message_type", recordField: column},
+			TimeColumn: "received_at",
+		},
+	}
+}
+
+func (i *Inbox) AcknowledgeDuplicate(c echo.Context, messageID string) (bool, error) {
+	var recordID int
+	err := i.db.QueryRow(
+		"UPDATE inbox SET deliveries = deliveries + 1, last_delivered_at = CURRENT_TIMESTAMP WHERE message_id = ? RETURNING "+i.column,
+		messageID,
+	).Scan(&recordID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.Response().Header().Set(DuplicateHeader, "true")
+	return true, c.JSON(http.StatusOK, map[string]interface{}{"status": "message already processed", "id": recordID, "messageId": messageID})
+}
+
+func (i *Inbox) Record(tx *sql.Tx, messageID string, messageType string, recordID int64) error {
+	_, err := tx.Exec("INSERT INTO inbox (message_id, message_type, "+i.column+") VALUES (?, ?, ?)", messageID, messageType, recordID)
+	return err
+}
+
+func (i *Inbox) HandleList(c echo.Context) error {
+	query, err := listing.Parse(c.QueryParams(), i.listing)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	statement, args := query.SQL("inbox", i.columns)
+	rows, err := i.db.Query(statement, args...)
+	if err != nil {
+		slog.Error("failed to fetch inbox", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch inbox"})
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	page := query.Page()
+	for rows.Next() {
+		var key string
+		message, err := i.scan(rows, &key)
+		if err != nil {
+			slog.Error("failed to scan inbox message", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read inbox"})
+		}
+		if !page.Add(key, message.ID) {
+			break
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read inbox", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read inbox"})
+	}
+
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
+	return c.JSON(http.StatusOK, messages)
+}
+
+func (i *Inbox) HandleGet(c echo.Context) error {
+	messageID := c.Param("messageId")
+
+	message, err := i.scan(i.db.QueryRow("SELECT "+i.columns+" FROM inbox WHERE message_id = ?", messageID))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "inbox message not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch inbox message", "messageId", messageID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch inbox message"})
+	}
+
+	return c.JSON(http.StatusOK, message)
+}
+
+func (i *Inbox) scan(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Message, error) {
+	message := Message{recordField: i.recordField}
+	dest := []interface{}{&message.ID, &message.MessageID, &message.MessageType, &message.RecordID, &message.Deliveries, &message.ReceivedAt, &message.LastDeliveredAt}
+	err := row.Scan(append(dest, extra...)...)
+	return message, err
+}
@@ -0,0 +1,97 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	StatusCreated   = "CREATED"
+	StatusPaid      = "PAID"
+	StatusFinished  = "FINISHED"
+	StatusCancelled = "CANCELLED"
+	StatusRefunded  = "REFUNDED"
+)
+
+const (
+	ActionPay    = "pay"
+	ActionFinish = "finish"
+	ActionCancel = "cancel"
+	ActionRefund = "refund"
+)
+
+var (
+	ErrUnknownAction     = errors.New("unknown order action")
+	ErrIllegalTransition = errors.New("illegal order transition")
+)
+
+type State struct {
+	Status string
+	Paid   bool
+}
+
+type Transition struct {
+	Action string
+	From   []string
+	To     string
+	Guard  func(State) error
+}
+
+var Transitions = []Transition{
+	{Action: ActionPay, From: []string{StatusCreated}, To: StatusPaid},
+	{Action: ActionFinish, From: []string{StatusPaid}, To: StatusFinished},
+	{Action: ActionCancel, From: []string{StatusCreated, StatusPaid, StatusFinished}, To: StatusCancelled},
+	{Action: ActionRefund, From: []string{StatusFinished, StatusCancelled}, To: StatusRefunded, Guard: requirePayment},
+}
+
+func Lookup(action string) (Transition, bool) {
+	for _, transition := range Transitions {
+		if transition.Action == action {
+			return transition, true
+		}
+	}
+	return Transition{}, false
+}
+
+func Apply(state State, action string) (Transition, error) {
+	transition, ok := Lookup(action)
+	if !ok {
+		return Transition{}, fmt.Errorf("%w: %s", ErrUnknownAction, action)
+	}
+	if !transition.allowedFrom(state.Status) {
+		return Transition{}, fmt.Errorf("%w: cannot %s an order that is %s (allowed from %s)", ErrIllegalTransition, action, state.Status, strings.Join(transition.From, ", "))
+	}
+	if transition.Guard != nil {
+		if err := transition.Guard(state); err != nil {
+			return Transition{}, fmt.Errorf("%w: %v", ErrIllegalTransition, err)
+		}
+	}
+	return transition, nil
+}
+
+func Actions(state State) []string {
+	var actions []string
+	for _, transition := range Transitions {
+		if _, err := Apply(state, transition.Action); err == nil {
+			actions = append(actions, transition.Action)
+		}
+	}
+	return actions
+}
+
+func (t Transition) allowedFrom(status string) bool {
+	for _, from := range t.From {
+		if from == status {
+			return true
+		}
+	}
+	return false
+}
+
+func requirePayment(state State) error {
+	if !state.Paid {
+		return fmt.Errorf("cannot refund an order that was never paid")
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package listing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+var timeFormats = []string{time.RFC3339Nano, sqliteTimeFormat, "2006-01-02T15:04:05", "2006-01-02"}
+
+type Spec struct {
+	Sorts      []string
+	Filters    map[string]string
+	TimeColumn string
+}
+
+type Query struct {
+	Limit  int
+	Sort   string
+	Desc   bool
+	where  []string
+	args   []interface{}
+	cursor *cursor
+}
+
+type cursor struct {
+	Key  string `json:"k"`
+	ID   int    `json:"id"`
+	Sort string `json:"s"`
+	Desc bool   `json:"d"`
+}
+
+func Parse(values url.Values, spec Spec) (Query, error) {
+	q := Query{Limit: DefaultLimit, Desc: true}
+	if len(spec.Sorts) > 0 {
+		q.Sort = spec.Sorts[0]
+	} else {
+		q.Sort = "id"
+	}
+
+	params := make([]string, 0, len(values))
+	for param := range values {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		if known := closestParam(param, spec); known != "" && known != param {
+			return q, fmt.Errorf("unknown query parameter %s, did you mean %s?", param, known)
+		}
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return q, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		q.Limit = limit
+	}
+
+	if raw := values.Get("sort"); raw != "" {
+		if raw != "id" && !contains(spec.Sorts, raw) {
+			return q, fmt.Errorf("sort must be one of: %s", strings.Join(append(append([]string{}, spec.Sorts...), "id"), ", "))
+		}
+		q.Sort = raw
+	}
+
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Desc = false
+	default:
+		return q, fmt.Errorf("order must be asc or desc")
+	}
+
+	for param, column := range spec.Filters {
+		raw := values.Get(param)
+		if raw == "" {
+			continue
+		}
+		options := strings.Split(raw, ",")
+		q.where = append(q.where, column+" IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(options)), ", ")+")")
+		for _, option := range options {
+			q.args = append(q.args, strings.TrimSpace(option))
+		}
+	}
+
+	if spec.TimeColumn != "" {
+		for param, operator := range map[string]string{"created_after": ">", "created_before": "<"} {
+			raw := values.Get(param)
+			if raw == "" {
+				continue
+			}
+			at, err := parseTime(raw)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time or date", param)
+			}
+			q.where = append(q.where, spec.TimeColumn+" "+operator+" ?")
+			q.args = append(q.args, at.UTC().Format(sqliteTimeFormat))
+		}
+	}
+
+	if raw := values.Get("after"); raw != "" {
+		decoded, err := decodeCursor(raw)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		if decoded.Sort != q.Sort || decoded.Desc != q.Desc {
+			return q, fmt.Errorf("cursor was issued for a different sort order")
+		}
+		q.cursor = &decoded
+	}
+
+	return q, nil
+}
+
+func (q Query) SQL(table string, columns string) (string, []interface{}) {
+	where := append([]string{}, q.where...)
+	args := append([]interface{}{}, q.args...)
+
+	operator := ">"
+	direction := "ASC"
+	if q.Desc {
+		operator = "<"
+		direction = "DESC"
+	}
+
+	if q.cursor != nil {
+		if q.Sort == "id" {
+			where = append(where, "id "+operator+" ?")
+			args = append(args, q.cursor.ID)
+		} else {
+			where = append(where, "("+q.Sort+" "+operator+" ? OR ("+q.Sort+" = ? AND id "+operator+" ?))")
+			args = append(args, q.cursor.Key, q.cursor.Key, q.cursor.ID)
+		}
+	}
+
+	query := "SELECT " + columns + ", CAST(" + q.Sort + " AS TEXT) FROM " + table
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if q.Sort == "id" {
+		query += " ORDER BY id " + direction
+	} else {
+		query += " ORDER BY " + q.Sort + " " + direction + ", id " + direction
+	}
+	query += " LIMIT ?"
+	args = append(args, q.Limit+1)
+	return query, args
+}
+
+type Page struct {
+	query Query
+	count int
+	last  cursor
+	next  string
+}
+
+func (q Query) Page() *Page {
+	return &Page{query: q}
+}
+
+func (p *Page) Add(key string, id int) bool {
+	p.count++
+	if p.count > p.query.Limit {
+		p.next = encodeCursor(p.last)
+		return false
+	}
+	p.last = cursor{Key: key, ID: id, Sort: p.query.Sort, Desc: p.query.Desc}
+	return true
+}
+
+func (p *Page) Next() string {
+	return p.next
+}
+
+func SetNext(header http.Header, requestURL *url.URL, next string) {
+	if next == "" {
+		return
+	}
+	header.Set("X-Next-Cursor", next)
+
+	link := *requestURL
+	values := link.Query()
+	values.Set("after", next)
+	link.RawQuery = values.Encode()
+	header.Set("Link", "<"+link.RequestURI()+`>; rel="next"`)
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(raw string) (cursor, error) {
+	var c cursor
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(decoded, &c)
+	return c, err
+}
+
+func parseTime(raw string) (time.Time, error) {
+	var err error
+	for _, format := range timeFormats {
+		var at time.Time
+		at, err = time.Parse(format, raw)
+		if err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func closestParam(param string, spec Spec) string {
+	known := []string{"limit", "after", "sort", "order"}
+	if spec.TimeColumn != "" {
+		known = append(known, "created_after", "created_before")
+	}
+	for filter := range spec.Filters {
+		known = append(known, filter)
+	}
+	sort.Strings(known)
+
+	closest, best := "", 0
+	for _, candidate := range known {
+		if candidate == param {
+			return param
+		}
+		tolerance := 1
+		if len(candidate) > 4 {
+			tolerance = 2
+		}
+		distance := editDistance(strings.ToLower(param), strings.ToLower(candidate))
+		if distance <= tolerance && (closest == "" || distance < best) {
+			closest, best = candidate, distance
+		}
+	}
+	return closest
+}
+
+func editDistance(a string, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Source struct {
+	Name  string
+	Path  string
+	FS    fs.FS
+	Dir   string
+	Table string
+	Adopt func(conn *sql.Conn) error
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+const defaultTable = "schema_migrations"
+
+func (s Source) table() string {
+	if s.Table == "" {
+		return defaultTable
+	}
+	return s.Table
+}
+
+func Open(databasePath string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", databasePath+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("PRAGMA journal_mode=WAL")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	_, err = db.Exec("PRAGMA busy_timeout=5000")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func Load(source Source) ([]Migration, error) {
+	entries, err := fs.ReadDir(source.FS, source.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations of %s: %w", source.Name, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		version, name, direction, err := parseFileName(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source.Name, err)
+		}
+
+		content, err := fs.ReadFile(source.FS, path.Join(source.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		if migration.Name != name {
+			return nil, fmt.Errorf("%s: migration %d has conflicting names %q and %q", source.Name, version, migration.Name, name)
+		}
+
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("%s: migration %d is missing its up file", source.Name, migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func parseFileName(fileName string) (int, string, string, error) {
+	base := strings.TrimSuffix(fileName, ".sql")
+
+	direction := ""
+	switch {
+	case strings.HasSuffix(base, ".up"):
+		direction = "up"
+	case strings.HasSuffix(base, ".down"):
+		direction = "down"
+	default:
+		return 0, "", "", fmt.Errorf("migration %s must end in .up.sql or .down.sql", fileName)
+	}
+	base = strings.TrimSuffix(base, "."+direction)
+
+	versionPart, name, ok := strings.Cut(base, "_")
+	if !ok {
+		return 0, "", "", fmt.Errorf("migration %s must be named <version>_<name>", fileName)
+	}
+
+	version, err := strconv.Atoi(versionPart)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("migration %s has invalid version: %w", fileName, err)
+	}
+
+	return version, name, direction, nil
+}
+
+func Up(db *sql.DB, source Source) (int, error) {
+	migrations, err := Load(source)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedVersions(db, source.table())
+	if err != nil {
+		return 0, err
+	}
+
+	if len(applied) == 0 && source.Adopt != nil {
+		if err := adopt(db, source.table(), source.Adopt); err != nil {
+			return 0, fmt.Errorf("%s: adopting existing schema failed: %w", source.Name, err)
+		}
+	}
+
+	count := 0
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		done, err := apply(db, source.table(), migration.Up, "INSERT INTO "+source.table()+" (version, name) VALUES (?, ?)", migration.Version, migration.Name, true)
+		if err != nil {
+			return count, fmt.Errorf("%s: migration %d_%s failed: %w", source.Name, migration.Version, migration.Name, err)
+		}
+		if done {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func Down(db *sql.DB, source Source, steps int) (int, error) {
+	migrations, err := Load(source)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedVersions(db, source.table())
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == "" {
+			return count, fmt.Errorf("%s: migration %d_%s has no down file", source.Name, migration.Version, migration.Name)
+		}
+
+		done, err := apply(db, source.table(), migration.Down, "DELETE FROM "+source.table()+" WHERE version = ? AND name = ?", migration.Version, migration.Name, false)
+		if err != nil {
+			return count, fmt.Errorf("%s: rollback of %d_%s failed: %w", source.Name, migration.Version, migration.Name, err)
+		}
+		if done {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func Statuses(db *sql.DB, source Source) ([]Status, error) {
+	migrations, err := Load(source)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedVersions(db, source.table())
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(migrations))
+	for _, migration := range migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func appliedVersions(db *sql.DB, table string) (map[int]time.Time, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + table + ` (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func apply(db *sql.DB, table string, statements string, bookkeeping string, version int, name string, up bool) (bool, error) {
+	done := false
+	err := immediate(db, func(ctx context.Context, conn *sql.Conn) error {
+		var applied bool
+		if err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+table+" WHERE version = ?)", version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied == up {
+			return nil
+		}
+
+		if _, err := conn.ExecContext(ctx, statements); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, bookkeeping, version, name); err != nil {
+			return err
+		}
+		done = true
+		return nil
+	})
+	return done, err
+}
+
+func adopt(db *sql.DB, table string, prepare func(conn *sql.Conn) error) error {
+	return immediate(db, func(ctx context.Context, conn *sql.Conn) error {
+		var applied bool
+		if err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+table+")").Scan(&applied); err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+		return prepare(conn)
+	})
+}
+
+func immediate(db *sql.DB, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	if err := fn(ctx, conn); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package notificationservice
+
+import "substack-outbox/delivery"
+
+type NotificationDelivery = delivery.Delivery
+
+var notificationDeliveryTable = delivery.Table{
+	Records:      "notifications",
+	Deliveries:   "notification_deliveries",
+	RecordColumn: "notification_id",
+	RecordField:  "notificationId",
+	TargetColumn: "device_id",
+	TargetField:  "deviceId",
+}
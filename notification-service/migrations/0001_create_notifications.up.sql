@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id TEXT NOT NULL,
+	message TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at DATETIME
+);
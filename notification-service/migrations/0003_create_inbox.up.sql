@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS inbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id TEXT NOT NULL UNIQUE,
+	message_type TEXT NOT NULL DEFAULT '',
+	notification_id INTEGER NOT NULL REFERENCES notifications(id),
+	deliveries INTEGER NOT NULL DEFAULT 1,
+	received_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_delivered_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_notifications_status_next_attempt;
+
+ALTER TABLE notifications DROP COLUMN failed_at;
+ALTER TABLE notifications DROP COLUMN next_attempt_at;
+ALTER TABLE notifications DROP COLUMN last_error;
+ALTER TABLE notifications DROP COLUMN attempts;
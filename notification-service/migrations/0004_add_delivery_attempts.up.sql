@@ -0,0 +1,6 @@
+ALTER TABLE notifications ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN last_error TEXT;
+ALTER TABLE notifications ADD COLUMN next_attempt_at DATETIME;
+ALTER TABLE notifications ADD COLUMN failed_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_notifications_status_next_attempt ON notifications (status, next_attempt_at);
@@ -0,0 +1,5 @@
+UPDATE notifications SET status = 'FAILED' WHERE status = 'PARTIAL';
+
+DROP INDEX IF EXISTS idx_notification_deliveries_status_next_attempt;
+DROP INDEX IF EXISTS idx_notification_deliveries_notification_id_device_id;
+DROP TABLE IF EXISTS notification_deliveries;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	notification_id INTEGER NOT NULL REFERENCES notifications(id),
+	device_id TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at DATETIME,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at DATETIME,
+	failed_at DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_deliveries_notification_id_device_id ON notification_deliveries (notification_id, device_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_status_next_attempt ON notification_deliveries (status, next_attempt_at);
+
+INSERT INTO notification_deliveries (notification_id, device_id, status, attempts, last_error, next_attempt_at, created_at, sent_at, failed_at)
+SELECT DISTINCT notifications.id, target.value, notifications.status, notifications.attempts, notifications.last_error, notifications.next_attempt_at, notifications.created_at, notifications.sent_at, notifications.failed_at
+FROM notifications, json_each(notifications.device_id) AS target;
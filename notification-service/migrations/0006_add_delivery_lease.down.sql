@@ -0,0 +1,3 @@
+UPDATE notification_deliveries SET status = 'PENDING' WHERE status = 'PROCESSING';
+ALTER TABLE notification_deliveries DROP COLUMN locked_until;
+ALTER TABLE notification_deliveries DROP COLUMN locked_by;
@@ -0,0 +1,2 @@
+ALTER TABLE notification_deliveries ADD COLUMN locked_by TEXT;
+ALTER TABLE notification_deliveries ADD COLUMN locked_until DATETIME;
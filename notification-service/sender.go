@@ -0,0 +1,21 @@
+package notificationservice
+
+import (
+	"context"
+	"log/slog"
+)
+
+type Sender interface {
+	Send(ctx context.Context, notification NotificationRecord, delivery NotificationDelivery) error
+}
+
+type SenderFunc func(ctx context.Context, notification NotificationRecord, delivery NotificationDelivery) error
+
+func (f SenderFunc) Send(ctx context.Context, notification NotificationRecord, delivery NotificationDelivery) error {
+	return f(ctx, notification, delivery)
+}
+
+var LogSender = SenderFunc(func(ctx context.Context, notification NotificationRecord, delivery NotificationDelivery) error {
+	slog.Info("notification delivered to log", "id", notification.ID, "deliveryId", delivery.ID, "deviceId", delivery.Target, "message", notification.Message)
+	return nil
+})
@@ -3,6 +3,7 @@ package notificationservice
 import (
 	"context"
 	"database/sql"
+	"embed"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -11,7 +12,12 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
-	_ "github.com/mattn/go-sqlite3"
+	"substack-outbox/delivery"
+	"substack-outbox/idempotency"
+	"substack-outbox/inbox"
+	"substack-outbox/listing"
+	"substack-outbox/migration"
+	"substack-outbox/outbox"
 )
 
 type NotificationRequest struct {
@@ -20,45 +26,74 @@ type NotificationRequest struct {
 }
 
 type NotificationRecord struct {
-	ID        int        `json:"id"`
-	DeviceID  string     `json:"deviceId"`
-	Message   string     `json:"message"`
-	Status    string     `json:"status"`
-	CreatedAt time.Time  `json:"created_at"`
-	SentAt    *time.Time `json:"sent_at,omitempty"`
+	ID            int                    `json:"id"`
+	DeviceID      string                 `json:"deviceId"`
+	Message       string                 `json:"message"`
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time             `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time              `json:"created_at"`
+	SentAt        *time.Time             `json:"sent_at,omitempty"`
+	FailedAt      *time.Time             `json:"failed_at,omitempty"`
+	Deliveries    []NotificationDelivery `json:"deliveries,omitempty"`
 }
 
+type WorkerConfig struct {
+	WorkerID      string
+	PollInterval  time.Duration
+	LeaseDuration time.Duration
+	MaxAttempts   int
+	Backoff       outbox.BackoffPolicy
+	FailureRate   float64
+	Sender        Sender
+}
+
+const databasePath = "./notification_service.db"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
 var db *sql.DB
 
-func initDB() error {
-	var err error
-	db, err = sql.Open("sqlite3", "./notification_service.db")
-	if err != nil {
-		return err
-	}
+var messageInbox *inbox.Inbox
 
-	_, err = db.Exec("PRAGMA journal_mode=WAL")
-	if err != nil {
-		return err
+var deliveryStore *delivery.Store
+
+const notificationColumns = "id, device_id, message, status, attempts, last_error, next_attempt_at, created_at, sent_at, failed_at"
+
+var notificationListing = listing.Spec{
+	Sorts:      []string{"created_at"},
+	Filters:    map[string]string{"status": "status"},
+	TimeColumn: "created_at",
+}
+
+func Migrations() []migration.Source {
+	return []migration.Source{
+		{Name: "notification-service", Path: databasePath, FS: migrationFiles, Dir: "migrations"},
 	}
+}
 
-	_, err = db.Exec("PRAGMA busy_timeout=5000")
+func initDB() error {
+	var err error
+	db, err = migration.Open(databasePath)
 	if err != nil {
 		return err
 	}
 
-	createTable := `
-	CREATE TABLE IF NOT EXISTS notifications (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id TEXT NOT NULL,
-		message TEXT NOT NULL,
-		status TEXT NOT NULL DEFAULT 'PENDING',
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		sent_at DATETIME
-	);`
+	for _, source := range Migrations() {
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			slog.Info("database migrated", "source", source.Name, "applied", applied)
+		}
+	}
 
-	_, err = db.Exec(createTable)
-	return err
+	deliveryStore = delivery.NewStore(db, notificationDeliveryTable)
+	messageInbox = inbox.New(db, "notification_id", "notificationId")
+	return nil
 }
 
 func Run(ctx context.Context, port string) error {
@@ -70,6 +105,9 @@ func Run(ctx context.Context, port string) error {
 	e := echo.New()
 	e.POST("/send-notification", handleSendNotification)
 	e.GET("/notifications", handleGetNotifications)
+	e.GET("/notifications/:id", handleGetNotification)
+	e.GET("/inbox", messageInbox.HandleList)
+	e.GET("/inbox/:messageId", messageInbox.HandleGet)
 
 	server := &http.Server{
 		Addr:    ":" + port,
@@ -93,10 +131,45 @@ func handleSendNotification(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
+	if len(req.DeviceID) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "at least one deviceId is required"})
+	}
+
+	messageID := c.Request().Header.Get(inbox.MessageIDHeader)
+	if messageID != "" {
+		duplicate, err := messageInbox.AcknowledgeDuplicate(c, messageID)
+		if err != nil {
+			slog.Error("failed to look up inbox message", "messageId", messageID, "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up inbox message"})
+		}
+		if duplicate {
+			slog.Info("duplicate notification message acknowledged", "messageId", messageID)
+			return nil
+		}
+	}
+
+	idempotencyKey := c.Request().Header.Get(idempotency.Header)
+	if idempotencyKey != "" {
+		replayed, err := idempotency.Replay(c, db, idempotencyKey)
+		if err != nil {
+			slog.Error("failed to look up idempotency key", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up idempotency key"})
+		}
+		if replayed {
+			slog.Info("duplicate notification request ignored", "idempotencyKey", idempotencyKey)
+			return nil
+		}
+	}
 
 	deviceIDJSON, _ := json.Marshal(req.DeviceID)
 
-	_, err := db.Exec(
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
 		"INSERT INTO notifications (device_id, message, status) VALUES (?, ?, ?)",
 		string(deviceIDJSON), req.Message, "PENDING",
 	)
@@ -104,88 +177,153 @@ func handleSendNotification(c echo.Context) error {
 		slog.Error("failed to insert notification", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store notification"})
 	}
+	id, _ := result.LastInsertId()
+
+	if err := deliveryStore.Insert(tx, id, req.DeviceID); err != nil {
+		slog.Error("failed to insert notification deliveries", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store notification"})
+	}
 
-	slog.Info("notification stored", "deviceId", req.DeviceID, "message", req.Message)
-	return c.JSON(http.StatusOK, map[string]string{"status": "notification stored successfully"})
+	response := map[string]interface{}{"status": "notification stored successfully", "id": id}
+	if messageID != "" {
+		if err := messageInbox.Record(tx, messageID, c.Request().Header.Get(inbox.MessageTypeHeader), id); err != nil {
+			if idempotency.IsUniqueViolation(err) {
+				tx.Rollback()
+				_, err = messageInbox.AcknowledgeDuplicate(c, messageID)
+				return err
+			}
+			slog.Error("failed to record inbox message", "messageId", messageID, "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store notification"})
+		}
+	}
+	if idempotencyKey != "" {
+		if err := idempotency.Save(tx, idempotencyKey, http.StatusOK, response); err != nil {
+			if idempotency.IsUniqueViolation(err) {
+				tx.Rollback()
+				_, err = idempotency.Replay(c, db, idempotencyKey)
+				return err
+			}
+			slog.Error("failed to store idempotency key", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store notification"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit notification", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store notification"})
+	}
+
+	slog.Info("notification stored", "id", id, "messageId", messageID, "schemaVersion", c.Request().Header.Get("X-Schema-Version"), "deviceId", req.DeviceID, "message", req.Message)
+	return c.JSON(http.StatusOK, response)
 }
 
 func handleGetNotifications(c echo.Context) error {
-	rows, err := db.Query("SELECT id, device_id, message, status, created_at, sent_at FROM notifications ORDER BY created_at DESC")
+	query, err := listing.Parse(c.QueryParams(), notificationListing)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	statement, args := query.SQL("notifications", notificationColumns)
+	rows, err := db.Query(statement, args...)
 	if err != nil {
+		slog.Error("failed to fetch notifications", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch notifications"})
 	}
 	defer rows.Close()
 
-	var notifications []NotificationRecord
+	notifications := []NotificationRecord{}
+	page := query.Page()
 	for rows.Next() {
-		var notification NotificationRecord
-		var sentAt sql.NullTime
-		err := rows.Scan(&notification.ID, &notification.DeviceID, &notification.Message, &notification.Status, &notification.CreatedAt, &sentAt)
+		var key string
+		notification, err := scanNotification(rows, &key)
 		if err != nil {
-			continue
+			slog.Error("failed to scan notification", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read notifications"})
 		}
-		if sentAt.Valid {
-			notification.SentAt = &sentAt.Time
+		if !page.Add(key, notification.ID) {
+			break
 		}
 		notifications = append(notifications, notification)
 	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read notifications", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read notifications"})
+	}
 
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
 	return c.JSON(http.StatusOK, notifications)
 }
 
-func RunWorker(ctx context.Context, cronPeriod string) error {
-	if err := initDB(); err != nil {
-		return fmt.Errorf("failed to init database: %w", err)
+func handleGetNotification(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid notification id"})
 	}
-	defer db.Close()
 
-	cronPeriodInt, _ := strconv.Atoi(cronPeriod)
-	ticker := time.NewTicker(time.Duration(cronPeriodInt) * time.Second)
-	defer ticker.Stop()
-
-	slog.Info("notification worker started", "cron_period", cronPeriod)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			processPendingNotifications()
-		}
+	notification, err := scanNotification(db.QueryRow("SELECT "+notificationColumns+" FROM notifications WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "notification not found"})
 	}
-}
-
-func processPendingNotifications() {
-	slog.Info("processing pending notifications")
-
-	countQuery := "SELECT COUNT(*) FROM notifications WHERE status = 'PENDING'"
-	var count int
-	err := db.QueryRow(countQuery).Scan(&count)
 	if err != nil {
-		slog.Error("failed to count pending notifications", "error", err)
-		return
+		slog.Error("failed to fetch notification", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch notification"})
 	}
-	slog.Info("found pending notifications", "count", count)
 
-	rows, err := db.Query("SELECT id, device_id, message FROM notifications WHERE status = 'PENDING'")
+	notification.Deliveries, err = deliveryStore.List(id)
 	if err != nil {
-		slog.Error("failed to query pending notifications", "error", err)
-		return
+		slog.Error("failed to fetch notification deliveries", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch notification"})
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var notification NotificationRecord
-		err := rows.Scan(&notification.ID, &notification.DeviceID, &notification.Message)
-		if err != nil {
-			continue
-		}
+	return c.JSON(http.StatusOK, notification)
+}
+
+func scanNotification(row interface{ Scan(...interface{}) error }, extra ...interface{}) (NotificationRecord, error) {
+	var notification NotificationRecord
+	var lastError sql.NullString
+	var nextAttemptAt, sentAt, failedAt sql.NullTime
+	dest := []interface{}{&notification.ID, &notification.DeviceID, &notification.Message, &notification.Status, &notification.Attempts, &lastError, &nextAttemptAt, &notification.CreatedAt, &sentAt, &failedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return notification, err
+	}
+	notification.LastError = lastError.String
+	if nextAttemptAt.Valid {
+		notification.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if sentAt.Valid {
+		notification.SentAt = &sentAt.Time
+	}
+	if failedAt.Valid {
+		notification.FailedAt = &failedAt.Time
+	}
+	return notification, nil
+}
+
+func RunWorker(ctx context.Context, cfg WorkerConfig) error {
+	if err := initDB(); err != nil {
+		return fmt.Errorf("failed to init database: %w", err)
+	}
+	defer db.Close()
 
-		slog.Info("processing notification", "id", notification.ID, "deviceId", notification.DeviceID, "message", notification.Message)
+	sender := cfg.Sender
+	if sender == nil {
+		sender = LogSender
+	}
 
-		_, err = db.Exec("UPDATE notifications SET status = 'SENT', sent_at = CURRENT_TIMESTAMP WHERE id = ?", notification.ID)
+	worker := delivery.NewWorker(deliveryStore, delivery.SenderFunc(func(ctx context.Context, delivery NotificationDelivery) error {
+		notification, err := scanNotification(db.QueryRow("SELECT "+notificationColumns+" FROM notifications WHERE id = ?", delivery.RecordID))
 		if err != nil {
-			slog.Error("failed to update notification status", "id", notification.ID, "error", err)
+			return fmt.Errorf("failed to fetch notification of delivery: %w", err)
 		}
-	}
+		return sender.Send(ctx, notification, delivery)
+	}), delivery.WorkerConfig{
+		Name:          "notification",
+		WorkerID:      cfg.WorkerID,
+		PollInterval:  cfg.PollInterval,
+		LeaseDuration: cfg.LeaseDuration,
+		MaxAttempts:   cfg.MaxAttempts,
+		Backoff:       cfg.Backoff,
+		FailureRate:   cfg.FailureRate,
+	})
+	return worker.Run(ctx)
 }
@@ -0,0 +1,139 @@
+package orderbasic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"substack-outbox/idempotency"
+	"substack-outbox/lifecycle"
+)
+
+var errOrderNotFound = errors.New("order not found")
+
+func handleCreateOrder(c echo.Context) error {
+	var req OrderRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if req.OrderID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "orderId is required"})
+	}
+
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	order, err := createOrder(c.Request().Context(), tx, req)
+	if idempotency.IsUniqueViolation(err) {
+		slog.Info("[ORDER-" + req.OrderID + "] rejected duplicate order")
+		return c.JSON(http.StatusConflict, map[string]string{"error": "order already exists", "orderId": req.OrderID})
+	}
+	if err != nil {
+		slog.Error("[ORDER-"+req.OrderID+"] failed to create order", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to commit transaction"})
+	}
+
+	slog.Info("[ORDER-" + req.OrderID + "] order created")
+	return c.JSON(http.StatusCreated, order)
+}
+
+func handleOrderTransition(action string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		orderID := c.Param("orderId")
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+		}
+		defer tx.Rollback()
+
+		order, err := transitionOrder(ctx, tx, orderID, action)
+		if errors.Is(err, errOrderNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+		}
+		if errors.Is(err, lifecycle.ErrIllegalTransition) {
+			slog.Info("[ORDER-"+orderID+"] rejected illegal order transition", "action", action, "error", err)
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error(), "orderId": orderID})
+		}
+		if err != nil {
+			slog.Error("[ORDER-"+orderID+"] failed to transition order", "action", action, "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to " + action + " order"})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to commit transaction"})
+		}
+
+		slog.Info("[ORDER-"+orderID+"] order transitioned", "action", action, "status", order.Status)
+		return c.JSON(http.StatusOK, order)
+	}
+}
+
+func createOrder(ctx context.Context, tx *sql.Tx, req OrderRequest) (OrderRecord, error) {
+	return scanOrder(tx.QueryRowContext(ctx,
+		"INSERT INTO orders (order_id, user_name, user_email, device_id, status) VALUES (?, ?, ?, ?, ?) RETURNING "+orderColumns,
+		req.OrderID, req.UserName, req.UserEmail, req.DeviceID, lifecycle.StatusCreated,
+	))
+}
+
+func transitionOrder(ctx context.Context, tx *sql.Tx, orderID string, action string) (OrderRecord, error) {
+	order, err := scanOrder(tx.QueryRowContext(ctx, "UPDATE orders SET updated_at = updated_at WHERE order_id = ? RETURNING "+orderColumns, orderID))
+	if err == sql.ErrNoRows {
+		return order, errOrderNotFound
+	}
+	if err != nil {
+		return order, err
+	}
+
+	transition, err := lifecycle.Apply(lifecycle.State{Status: order.Status, Paid: order.PaidAt != nil}, action)
+	if err != nil {
+		return order, err
+	}
+
+	update := "UPDATE orders SET status = ?, updated_at = CURRENT_TIMESTAMP"
+	if transition.To == lifecycle.StatusPaid {
+		update += ", paid_at = CURRENT_TIMESTAMP"
+	}
+	order, err = scanOrder(tx.QueryRowContext(ctx, update+" WHERE order_id = ? RETURNING "+orderColumns, transition.To, orderID))
+	if err != nil {
+		return order, err
+	}
+	slog.Info("[ORDER-" + orderID + "] order " + order.Status)
+
+	if order.Status == lifecycle.StatusFinished {
+		if err := notifyCompletion(order); err != nil {
+			return order, err
+		}
+	}
+	return order, nil
+}
+
+func notifyCompletion(order OrderRecord) error {
+	if err := callEmailService(order); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	slog.Info("[ORDER-" + order.OrderID + "] email service called")
+
+	if err := callNotificationService(order); err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	slog.Info("[ORDER-" + order.OrderID + "] notification service called")
+
+	if err := callGoogleAnalytics(order); err != nil {
+		return fmt.Errorf("failed to send analytics: %w", err)
+	}
+	slog.Info("[ORDER-" + order.OrderID + "] google analytics called")
+	return nil
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_orders_order_id;
+
+INSERT INTO orders SELECT * FROM orders_duplicates;
+DROP TABLE IF EXISTS orders_duplicates;
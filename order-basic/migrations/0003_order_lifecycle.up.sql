@@ -0,0 +1,4 @@
+ALTER TABLE orders ADD COLUMN paid_at DATETIME;
+
+UPDATE orders SET status = 'CREATED' WHERE status = 'PENDING';
+UPDATE orders SET paid_at = updated_at WHERE status = 'FINISHED';
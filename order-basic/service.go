@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"embed"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -12,7 +13,10 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
-	_ "github.com/mattn/go-sqlite3"
+	"substack-outbox/idempotency"
+	"substack-outbox/lifecycle"
+	"substack-outbox/listing"
+	"substack-outbox/migration"
 )
 
 type OrderRequest struct {
@@ -23,49 +27,69 @@ type OrderRequest struct {
 }
 
 type OrderRecord struct {
-	ID        int       `json:"id"`
-	OrderID   string    `json:"orderId"`
-	UserName  string    `json:"userName"`
-	UserEmail string    `json:"userEmail"`
-	DeviceID  string    `json:"deviceId"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id"`
+	OrderID   string     `json:"orderId"`
+	UserName  string     `json:"userName"`
+	UserEmail string     `json:"userEmail"`
+	DeviceID  string     `json:"deviceId"`
+	Status    string     `json:"status"`
+	PaidAt    *time.Time `json:"paidAt,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
 }
 
+const databasePath = "./order_basic.db"
+
+const (
+	emailServiceURL        = "http://localhost:8081/send-email"
+	notificationServiceURL = "http://localhost:8082/send-notification"
+	googleAnalyticsURL     = "http://localhost:9000/events"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
 var db *sql.DB
 
+const orderColumns = "id, order_id, user_name, user_email, device_id, status, paid_at, created_at, updated_at"
+
+var orderListing = listing.Spec{
+	Sorts:      []string{"created_at", "updated_at"},
+	Filters:    map[string]string{"status": "status", "orderId": "order_id"},
+	TimeColumn: "created_at",
+}
+
+func Migrations() []migration.Source {
+	return []migration.Source{
+		{Name: "order-basic", Path: databasePath, FS: migrationFiles, Dir: "migrations"},
+	}
+}
+
 func initDB() error {
 	var err error
-	db, err = sql.Open("sqlite3", "./order_basic.db")
+	db, err = migration.Open(databasePath)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("PRAGMA journal_mode=WAL")
-	if err != nil {
-		return err
+	for _, source := range Migrations() {
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			slog.Info("database migrated", "source", source.Name, "applied", applied)
+		}
 	}
 
-	_, err = db.Exec("PRAGMA busy_timeout=5000")
-	if err != nil {
+	var duplicates int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orders_duplicates").Scan(&duplicates); err != nil {
 		return err
 	}
-
-	createTable := `
-	CREATE TABLE IF NOT EXISTS orders (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		order_id TEXT NOT NULL,
-		user_name TEXT NOT NULL,
-		user_email TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		status TEXT NOT NULL DEFAULT 'PENDING',
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	_, err = db.Exec(createTable)
-	return err
+	if duplicates > 0 {
+		slog.Warn("duplicate orders were moved out of orders when order_id became unique, review and delete them", "table", "orders_duplicates", "count", duplicates)
+	}
+	return nil
 }
 
 func Run(ctx context.Context, port string) error {
@@ -74,13 +98,9 @@ func Run(ctx context.Context, port string) error {
 	}
 	defer db.Close()
 
-	e := echo.New()
-	e.POST("/finish-order", handleFinishOrder)
-	e.GET("/orders", handleGetOrders)
-
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: e,
+		Handler: newServer(),
 	}
 
 	go func() {
@@ -95,22 +115,38 @@ func Run(ctx context.Context, port string) error {
 	return server.Shutdown(context.Background())
 }
 
+func newServer() *echo.Echo {
+	e := echo.New()
+	e.POST("/finish-order", handleFinishOrder)
+	e.POST("/orders", handleCreateOrder)
+	for _, transition := range lifecycle.Transitions {
+		e.POST("/orders/:orderId/"+transition.Action, handleOrderTransition(transition.Action))
+	}
+	e.GET("/orders", handleGetOrders)
+	e.GET("/orders/:orderId", handleGetOrder)
+	return e
+}
+
 func handleFinishOrder(c echo.Context) error {
 	var req OrderRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
+	if req.OrderID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "orderId is required"})
+	}
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(c.Request().Context(), nil)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec(
-		"INSERT INTO orders (order_id, user_name, user_email, device_id, status) VALUES (?, ?, ?, ?, ?)",
-		req.OrderID, req.UserName, req.UserEmail, req.DeviceID, "PENDING",
-	)
+	_, err = createOrder(c.Request().Context(), tx, req)
+	if idempotency.IsUniqueViolation(err) {
+		slog.Info("[ORDER-" + req.OrderID + "] rejected duplicate order")
+		return c.JSON(http.StatusConflict, map[string]string{"error": "order already exists", "orderId": req.OrderID})
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
 	}
@@ -121,29 +157,12 @@ func handleFinishOrder(c echo.Context) error {
 	}
 	slog.Info("[ORDER-" + req.OrderID + "] order created")
 
-	_, err = tx.Exec("UPDATE orders SET status = 'FINISHED', updated_at = CURRENT_TIMESTAMP WHERE order_id = ?", req.OrderID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update order status"})
-	}
-	slog.Info("[ORDER-" + req.OrderID + "] order updated")
-
-	if err := callEmailService(req); err != nil {
-		slog.Error("[ORDER-"+req.OrderID+"] failed to call email service", "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to send email"})
-	}
-	slog.Info("[ORDER-" + req.OrderID + "] email service called")
-
-	if err := callNotificationService(req); err != nil {
-		slog.Error("[ORDER-"+req.OrderID+"] failed to call notification service", "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to send notification"})
-	}
-	slog.Info("[ORDER-" + req.OrderID + "] notification service called")
-
-	if err := callGoogleAnalytics(req); err != nil {
-		slog.Error("[ORDER-"+req.OrderID+"] failed to call google analytics", "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to send analytics"})
+	for _, action := range []string{lifecycle.ActionPay, lifecycle.ActionFinish} {
+		if _, err := transitionOrder(c.Request().Context(), tx, req.OrderID, action); err != nil {
+			slog.Error("[ORDER-"+req.OrderID+"] failed to "+action+" order", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
 	}
-	slog.Info("[ORDER-" + req.OrderID + "] google analytics called")
 
 	if err := tx.Commit(); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to commit transaction"})
@@ -153,101 +172,117 @@ func handleFinishOrder(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"status": "order finished successfully"})
 }
 
-func callEmailService(req OrderRequest) error {
+func callEmailService(order OrderRecord) error {
 	if rand.Float32() < 0.3 {
 		return fmt.Errorf("random failure in email service")
 	}
 
-	emailData := map[string]interface{}{
-		"recipients": []string{req.UserEmail},
+	return postJSON(emailServiceURL, map[string]interface{}{
+		"recipients": []string{order.UserEmail},
 		"subject":    "Order Completed",
-		"body":       fmt.Sprintf("Your order %s has been completed successfully!", req.OrderID),
-	}
-
-	jsonData, _ := json.Marshal(emailData)
-	resp, err := http.Post("http://localhost:8081/send-email", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("email service returned status: %d", resp.StatusCode)
-	}
-
-	return nil
+		"body":       fmt.Sprintf("Your order %s has been completed successfully!", order.OrderID),
+	})
 }
 
-func callNotificationService(req OrderRequest) error {
+func callNotificationService(order OrderRecord) error {
 	if rand.Float32() < 0.3 {
 		return fmt.Errorf("random failure in notification service")
 	}
 
-	notificationData := map[string]interface{}{
-		"deviceId": []string{req.DeviceID},
-		"message":  fmt.Sprintf("Order %s completed successfully!", req.OrderID),
-	}
-
-	jsonData, _ := json.Marshal(notificationData)
-	resp, err := http.Post("http://localhost:8082/send-notification", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("notification service returned status: %d", resp.StatusCode)
-	}
-
-	return nil
+	return postJSON(notificationServiceURL, map[string]interface{}{
+		"deviceId": []string{order.DeviceID},
+		"message":  fmt.Sprintf("Order %s completed successfully!", order.OrderID),
+	})
 }
 
-func callGoogleAnalytics(req OrderRequest) error {
+func callGoogleAnalytics(order OrderRecord) error {
 	if rand.Float32() < 0.3 {
 		return fmt.Errorf("random failure in google analytics")
 	}
 
-	analyticsData := map[string]interface{}{
-		"event":     "order_completed",
-		"orderId":   req.OrderID,
-		"userEmail": req.UserEmail,
-		"timestamp": time.Now(),
-	}
-
-	payloadData := map[string]interface{}{
-		"payload": analyticsData,
-	}
+	return postJSON(googleAnalyticsURL, map[string]interface{}{
+		"payload": map[string]interface{}{
+			"event":     "order_completed",
+			"orderId":   order.OrderID,
+			"userEmail": order.UserEmail,
+			"timestamp": time.Now(),
+		},
+	})
+}
 
-	jsonData, _ := json.Marshal(payloadData)
-	resp, err := http.Post("http://localhost:9000/events", "application/json", bytes.NewBuffer(jsonData))
+func postJSON(url string, data interface{}) error {
+	jsonData, _ := json.Marshal(data)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("google analytics returned status: %d", resp.StatusCode)
+		return fmt.Errorf("%s returned status: %d", url, resp.StatusCode)
 	}
 
 	return nil
 }
 
 func handleGetOrders(c echo.Context) error {
-	rows, err := db.Query("SELECT id, order_id, user_name, user_email, device_id, status, created_at, updated_at FROM orders ORDER BY created_at DESC")
+	query, err := listing.Parse(c.QueryParams(), orderListing)
 	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	statement, args := query.SQL("orders", orderColumns)
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		slog.Error("failed to fetch orders", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch orders"})
 	}
 	defer rows.Close()
 
-	var orders []OrderRecord
+	orders := []OrderRecord{}
+	page := query.Page()
 	for rows.Next() {
-		var order OrderRecord
-		err := rows.Scan(&order.ID, &order.OrderID, &order.UserName, &order.UserEmail, &order.DeviceID, &order.Status, &order.CreatedAt, &order.UpdatedAt)
+		var key string
+		order, err := scanOrder(rows, &key)
 		if err != nil {
-			continue
+			slog.Error("failed to scan order", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read orders"})
+		}
+		if !page.Add(key, order.ID) {
+			break
 		}
 		orders = append(orders, order)
 	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read orders", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read orders"})
+	}
 
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
 	return c.JSON(http.StatusOK, orders)
 }
+
+func handleGetOrder(c echo.Context) error {
+	orderID := c.Param("orderId")
+	order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order"})
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func scanOrder(row interface{ Scan(...interface{}) error }, extra ...interface{}) (OrderRecord, error) {
+	var order OrderRecord
+	var paidAt sql.NullTime
+	dest := []interface{}{&order.ID, &order.OrderID, &order.UserName, &order.UserEmail, &order.DeviceID, &order.Status, &paidAt, &order.CreatedAt, &order.UpdatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if paidAt.Valid {
+		order.PaidAt = &paidAt.Time
+	}
+	return order, err
+}
@@ -0,0 +1,53 @@
+package orderbasic
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newTestServer(t *testing.T) *echo.Echo {
+	t.Chdir(t.TempDir())
+	if err := initDB(); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newServer()
+}
+
+func postOrder(t *testing.T, e *echo.Echo, path string, req OrderRequest) *httptest.ResponseRecorder {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal order: %v", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCreateOrderTwice(t *testing.T) {
+	e := newTestServer(t)
+	req := OrderRequest{OrderID: "ORDER-1", UserName: "User1", UserEmail: "user1@example.com", DeviceID: "DEVICE-1"}
+
+	if first := postOrder(t, e, "/orders", req); first.Code != http.StatusCreated {
+		t.Fatalf("first request: got %d %s, want 201", first.Code, first.Body)
+	}
+	if duplicate := postOrder(t, e, "/orders", req); duplicate.Code != http.StatusConflict {
+		t.Fatalf("duplicate: got %d %s, want 409", duplicate.Code, duplicate.Body)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orders WHERE order_id = ?", req.OrderID).Scan(&count); err != nil {
+		t.Fatalf("count orders: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("got %d order rows, want 1", count)
+	}
+}
@@ -0,0 +1,312 @@
+package orderimproved
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"substack-outbox/events"
+	"substack-outbox/idempotency"
+	"substack-outbox/lifecycle"
+)
+
+var errOrderNotFound = errors.New("order not found")
+
+var errCannotFinish = errors.New("order cannot be finished")
+
+func handleCreateOrder(c echo.Context) error {
+	return placeOrder(c, nil, func(order OrderRecord) (int, interface{}) {
+		return http.StatusCreated, order
+	})
+}
+
+func handleOrderTransition(action string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		orderID := c.Param("orderId")
+
+		idempotencyKey := c.Request().Header.Get(idempotency.Header)
+		if idempotencyKey != "" {
+			replayed, err := idempotency.Replay(c, db, idempotencyKey)
+			if err != nil {
+				slog.Error("failed to look up idempotency key", "orderId", orderID, "error", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up idempotency key"})
+			}
+			if replayed {
+				slog.Info("replayed order transition for repeated idempotency key", "orderId", orderID, "action", action, "idempotencyKey", idempotencyKey)
+				return nil
+			}
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			slog.Error("failed to start transaction", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+		}
+		defer tx.Rollback()
+
+		order, err := transitionOrder(ctx, tx, orderID, action, requestCorrelationID(c, orderID), idempotencyKey)
+		if err != nil {
+			return transitionFailed(c, orderID, action, err)
+		}
+
+		if committed, err := commitOrderChange(c, tx, orderID, idempotencyKey, http.StatusOK, order); !committed {
+			return err
+		}
+
+		slog.Info("order transitioned", "orderId", orderID, "action", action, "status", order.Status)
+		return c.JSON(http.StatusOK, order)
+	}
+}
+
+func placeOrder(c echo.Context, actions []string, respond func(OrderRecord) (int, interface{})) error {
+	ctx := c.Request().Context()
+
+	var req OrderRequest
+	if err := c.Bind(&req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+
+	if req.OrderID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "orderId is required"})
+	}
+
+	slog.Info("processing order request", "orderId", req.OrderID, "userName", req.UserName, "userEmail", req.UserEmail, "deviceId", req.DeviceID)
+
+	idempotencyKey := c.Request().Header.Get(idempotency.Header)
+	if idempotencyKey != "" {
+		replayed, err := idempotency.Replay(c, db, idempotencyKey)
+		if err != nil {
+			slog.Error("failed to look up idempotency key", "orderId", req.OrderID, "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up idempotency key"})
+		}
+		if replayed {
+			slog.Info("replayed order response for repeated idempotency key", "orderId", req.OrderID, "idempotencyKey", idempotencyKey)
+			return nil
+		}
+	}
+
+	if rand.Float32() < 0.1 {
+		slog.Info("random failure occurred during order processing", "orderId", req.OrderID)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "random failure occurred"})
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("failed to start transaction", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	slog.Info("transaction started", "orderId", req.OrderID)
+
+	correlationID := requestCorrelationID(c, req.OrderID)
+	order, err := createOrder(ctx, tx, req, correlationID, idempotencyKey)
+	if idempotency.IsUniqueViolation(err) {
+		tx.Rollback()
+		if idempotencyKey != "" {
+			replayed, err := idempotency.Replay(c, db, idempotencyKey)
+			if err != nil {
+				slog.Error("failed to look up idempotency key", "orderId", req.OrderID, "error", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to look up idempotency key"})
+			}
+			if replayed {
+				slog.Info("concurrent request with same idempotency key already placed the order", "orderId", req.OrderID, "idempotencyKey", idempotencyKey)
+				return nil
+			}
+		}
+		slog.Info("rejected duplicate order", "orderId", req.OrderID)
+		return c.JSON(http.StatusConflict, map[string]string{"error": "order already exists", "orderId": req.OrderID})
+	}
+	if err != nil {
+		slog.Error("failed to create order", "orderId", req.OrderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
+	}
+
+	for _, action := range actions {
+		order, err = transitionOrder(ctx, tx, req.OrderID, action, correlationID, idempotencyKey)
+		if err != nil {
+			return transitionFailed(c, req.OrderID, action, err)
+		}
+	}
+
+	statusCode, response := respond(order)
+	if committed, err := commitOrderChange(c, tx, req.OrderID, idempotencyKey, statusCode, response); !committed {
+		return err
+	}
+
+	slog.Info("order placed with outbox messages", "orderId", req.OrderID, "status", order.Status)
+	return c.JSON(statusCode, response)
+}
+
+func createOrder(ctx context.Context, tx *sql.Tx, req OrderRequest, correlationID string, causationID string) (OrderRecord, error) {
+	order, err := scanOrder(tx.QueryRowContext(ctx,
+		"INSERT INTO orders (order_id, user_name, user_email, device_id, status) VALUES (?, ?, ?, ?, ?) RETURNING "+orderColumns,
+		req.OrderID, req.UserName, req.UserEmail, req.DeviceID, lifecycle.StatusCreated,
+	))
+	if err != nil {
+		return order, err
+	}
+
+	created := events.OrderStatusChanged{OrderID: order.OrderID, Status: order.Status, ChangedAt: time.Now().UTC()}
+	if err := createOutboxMessage(ctx, tx, order.OrderID, correlationID, causationID, created); err != nil {
+		return order, fmt.Errorf("failed to create %s outbox message: %w", created.MessageType(), err)
+	}
+	slog.Info("[ORDER-"+order.OrderID+"] outbox message created", "type", created.MessageType())
+	return order, nil
+}
+
+func transitionOrder(ctx context.Context, tx *sql.Tx, orderID string, action string, correlationID string, causationID string) (OrderRecord, error) {
+	order, err := scanOrder(tx.QueryRowContext(ctx, "UPDATE orders SET updated_at = updated_at WHERE order_id = ? RETURNING "+orderColumns, orderID))
+	if err == sql.ErrNoRows {
+		return order, errOrderNotFound
+	}
+	if err != nil {
+		return order, err
+	}
+
+	transition, err := lifecycle.Apply(order.state(), action)
+	if err != nil {
+		return order, err
+	}
+	if transition.To == lifecycle.StatusFinished {
+		for _, payload := range completionPayloads(order) {
+			if err := payload.Validate(); err != nil {
+				return order, fmt.Errorf("%w: %w", errCannotFinish, err)
+			}
+		}
+	}
+
+	update := "UPDATE orders SET status = ?, updated_at = CURRENT_TIMESTAMP"
+	if transition.To == lifecycle.StatusPaid {
+		update += ", paid_at = CURRENT_TIMESTAMP"
+	}
+	fromStatus := order.Status
+	order, err = scanOrder(tx.QueryRowContext(ctx, update+" WHERE order_id = ? RETURNING "+orderColumns, transition.To, orderID))
+	if err != nil {
+		return order, err
+	}
+
+	payloads := []events.Payload{events.OrderStatusChanged{
+		OrderID:    order.OrderID,
+		Action:     action,
+		FromStatus: fromStatus,
+		Status:     order.Status,
+		ChangedAt:  time.Now().UTC(),
+	}}
+	switch order.Status {
+	case lifecycle.StatusFinished:
+		payloads = append(payloads, completionPayloads(order)...)
+	case lifecycle.StatusCancelled:
+		payloads = append(payloads, compensationPayloads(order, fromStatus == lifecycle.StatusFinished)...)
+	}
+	for _, payload := range payloads {
+		if err := createOutboxMessage(ctx, tx, order.OrderID, correlationID, causationID, payload); err != nil {
+			return order, fmt.Errorf("failed to create %s outbox message: %w", payload.MessageType(), err)
+		}
+		slog.Info("[ORDER-"+order.OrderID+"] outbox message created", "type", payload.MessageType())
+	}
+	return order, nil
+}
+
+func completionPayloads(order OrderRecord) []events.Payload {
+	return []events.Payload{
+		events.Email{
+			Recipients: []string{order.UserEmail},
+			Subject:    "Order Completed",
+			Body:       fmt.Sprintf("Your order %s has been completed successfully!", order.OrderID),
+		},
+		events.Notify{
+			DeviceID: []string{order.DeviceID},
+			Message:  fmt.Sprintf("Order %s completed successfully!", order.OrderID),
+		},
+		events.Analytic{
+			Event:     "order_completed",
+			OrderID:   order.OrderID,
+			UserEmail: order.UserEmail,
+			Timestamp: time.Now(),
+		},
+	}
+}
+
+func compensationPayloads(order OrderRecord, completed bool) []events.Payload {
+	email := events.Email{
+		Recipients: []string{order.UserEmail},
+		Subject:    "Order Cancelled",
+		Body:       fmt.Sprintf("Your order %s has been cancelled. We apologize for the inconvenience.", order.OrderID),
+	}
+	if completed {
+		email.Body += " Please disregard the earlier order confirmation."
+	}
+
+	payloads := []events.Payload{email}
+	if completed {
+		payloads = append(payloads, events.Notify{
+			DeviceID: []string{order.DeviceID},
+			Message:  fmt.Sprintf("Order %s was cancelled, please disregard the earlier completion notice.", order.OrderID),
+		})
+	}
+	return append(payloads, events.Analytic{
+		Event:     "order_cancelled",
+		OrderID:   order.OrderID,
+		UserEmail: order.UserEmail,
+		Timestamp: time.Now(),
+	})
+}
+
+func commitOrderChange(c echo.Context, tx *sql.Tx, orderID string, idempotencyKey string, statusCode int, response interface{}) (bool, error) {
+	if idempotencyKey != "" {
+		if err := idempotency.Save(tx, idempotencyKey, statusCode, response); err != nil {
+			if idempotency.IsUniqueViolation(err) {
+				tx.Rollback()
+				slog.Info("concurrent request with same idempotency key already changed the order", "orderId", orderID, "idempotencyKey", idempotencyKey)
+				_, err = idempotency.Replay(c, db, idempotencyKey)
+				return false, err
+			}
+			slog.Error("failed to store idempotency key", "orderId", orderID, "error", err)
+			return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store idempotency key"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit transaction", "orderId", orderID, "error", err)
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to commit transaction"})
+	}
+
+	outboxNotifier.Notify()
+	return true, nil
+}
+
+func transitionFailed(c echo.Context, orderID string, action string, err error) error {
+	if errors.Is(err, errOrderNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+	}
+	if errors.Is(err, errCannotFinish) {
+		slog.Info("rejected order with invalid outbox payload", "orderId", orderID, "action", action, "error", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error(), "orderId": orderID})
+	}
+	if errors.Is(err, lifecycle.ErrIllegalTransition) {
+		slog.Info("rejected illegal order transition", "orderId", orderID, "action", action, "error", err)
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error(), "orderId": orderID})
+	}
+	slog.Error("failed to transition order", "orderId", orderID, "action", action, "error", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to " + action + " order"})
+}
+
+func requestCorrelationID(c echo.Context, orderID string) string {
+	if correlationID := c.Request().Header.Get(correlationIDHeader); correlationID != "" {
+		return correlationID
+	}
+	return orderID
+}
+
+func (o OrderRecord) state() lifecycle.State {
+	return lifecycle.State{Status: o.Status, Paid: o.PaidAt != nil}
+}
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS orders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL,
+	user_name TEXT NOT NULL,
+	user_email TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	type TEXT NOT NULL,
+	data TEXT NOT NULL,
+	idempotency_key TEXT UNIQUE,
+	aggregate_id TEXT,
+	sequence INTEGER,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	locked_by TEXT,
+	locked_until DATETIME,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_outbox_aggregate_sequence ON outbox (aggregate_id, sequence);
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS order_status_history_after_update;
+DROP TRIGGER IF EXISTS order_status_history_after_insert;
+DROP INDEX IF EXISTS idx_order_status_history_order_id;
+DROP TABLE IF EXISTS order_status_history;
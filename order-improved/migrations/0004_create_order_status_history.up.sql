@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS order_status_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL,
+	from_status TEXT,
+	to_status TEXT NOT NULL,
+	changed_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history (order_id);
+
+CREATE TRIGGER IF NOT EXISTS order_status_history_after_insert
+AFTER INSERT ON orders
+BEGIN
+	INSERT INTO order_status_history (order_id, from_status, to_status) VALUES (NEW.order_id, NULL, NEW.status);
+END;
+
+CREATE TRIGGER IF NOT EXISTS order_status_history_after_update
+AFTER UPDATE OF status ON orders
+WHEN OLD.status IS NOT NEW.status
+BEGIN
+	INSERT INTO order_status_history (order_id, from_status, to_status) VALUES (NEW.order_id, OLD.status, NEW.status);
+END;
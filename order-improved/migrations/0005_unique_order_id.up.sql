@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS orders_duplicates AS
+SELECT * FROM orders WHERE id NOT IN (SELECT MIN(id) FROM orders GROUP BY order_id);
+
+DELETE FROM orders WHERE id IN (SELECT id FROM orders_duplicates);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_order_id ON orders (order_id);
@@ -0,0 +1,3 @@
+UPDATE orders SET status = 'PENDING' WHERE status = 'CREATED';
+
+ALTER TABLE orders DROP COLUMN paid_at;
@@ -0,0 +1 @@
+DELETE FROM outbox_schema_migrations WHERE version = 1 AND NOT EXISTS (SELECT 1 FROM outbox_schema_migrations WHERE version > 1);
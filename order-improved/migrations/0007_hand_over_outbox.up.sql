@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS outbox_schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT OR IGNORE INTO outbox_schema_migrations (version, name) VALUES (1, 'create_outbox');
@@ -3,15 +3,20 @@ package orderimproved
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"embed"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
-	_ "github.com/mattn/go-sqlite3"
+	"substack-outbox/events"
+	"substack-outbox/lifecycle"
+	"substack-outbox/listing"
+	"substack-outbox/migration"
+	"substack-outbox/outbox"
 )
 
 type OrderRequest struct {
@@ -22,99 +27,138 @@ type OrderRequest struct {
 }
 
 type OrderRecord struct {
-	ID        int       `json:"id"`
-	OrderID   string    `json:"orderId"`
-	UserName  string    `json:"userName"`
-	UserEmail string    `json:"userEmail"`
-	DeviceID  string    `json:"deviceId"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id"`
+	OrderID   string     `json:"orderId"`
+	UserName  string     `json:"userName"`
+	UserEmail string     `json:"userEmail"`
+	DeviceID  string     `json:"deviceId"`
+	Status    string     `json:"status"`
+	PaidAt    *time.Time `json:"paidAt,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
 }
 
-type OutboxMessage struct {
-	ID         int             `json:"id"`
-	Status     string          `json:"status"`
-	Type       string          `json:"type"`
-	Data       json.RawMessage `json:"data"`
-	CreatedAt  time.Time       `json:"created_at"`
-	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+type OrderDetail struct {
+	OrderRecord
+	Outbox []outbox.Message `json:"outbox"`
 }
 
+const databasePath = "./order_improved.db"
+
+const correlationIDHeader = "X-Correlation-Id"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
 var db *sql.DB
 
-func initDB() error {
-	var err error
-	db, err = sql.Open("sqlite3", "./order_improved.db")
-	if err != nil {
-		return err
-	}
+const orderColumns = "id, order_id, user_name, user_email, device_id, status, paid_at, created_at, updated_at"
 
-	_, err = db.Exec("PRAGMA journal_mode=WAL")
-	if err != nil {
-		return err
-	}
+var orderListing = listing.Spec{
+	Sorts:      []string{"created_at", "updated_at"},
+	Filters:    map[string]string{"status": "status", "orderId": "order_id"},
+	TimeColumn: "created_at",
+}
 
-	_, err = db.Exec("PRAGMA busy_timeout=5000")
-	if err != nil {
-		return err
-	}
+var outboxListing = listing.Spec{
+	Sorts:      []string{"created_at", "next_attempt_at"},
+	Filters:    map[string]string{"status": "status", "type": "type", "orderId": "aggregate_id", "stream": "stream"},
+	TimeColumn: "created_at",
+}
 
-	_, err = db.Exec("DROP TABLE IF EXISTS orders")
-	if err != nil {
-		return err
-	}
+var outboxStore *outbox.SQLStore
 
-	_, err = db.Exec("DROP TABLE IF EXISTS outbox")
-	if err != nil {
-		return err
-	}
+var outboxNotifier outbox.Notifier = outbox.NopNotifier{}
 
-	createOrdersTable := `
-	CREATE TABLE orders (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		order_id TEXT NOT NULL,
-		user_name TEXT NOT NULL,
-		user_email TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		status TEXT NOT NULL DEFAULT 'PENDING',
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-	);`
+func Migrations() []migration.Source {
+	return []migration.Source{
+		{Name: "order-improved", Path: databasePath, FS: migrationFiles, Dir: "migrations", Adopt: adoptLegacyOutbox},
+		outbox.Migrations("order-improved", databasePath),
+	}
+}
 
-	createOutboxTable := `
-	CREATE TABLE outbox (
+const rebuildLegacyOutbox = `
+	CREATE TABLE outbox_legacy (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		status TEXT NOT NULL DEFAULT 'PENDING',
 		type TEXT NOT NULL,
 		data TEXT NOT NULL,
+		idempotency_key TEXT UNIQUE,
+		aggregate_id TEXT,
+		sequence INTEGER,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		locked_by TEXT,
+		locked_until DATETIME,
 		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		finished_at DATETIME
-	);`
+	);
+
+	INSERT INTO outbox_legacy (id, status, type, data, created_at, finished_at)
+	SELECT id, status, type, data, created_at, finished_at FROM outbox;
+
+	DROP TABLE outbox;
+	ALTER TABLE outbox_legacy RENAME TO outbox;`
 
-	_, err = db.Exec(createOrdersTable)
+func adoptLegacyOutbox(conn *sql.Conn) error {
+	ctx := context.Background()
+	var columns, aggregateColumns int
+	err := conn.QueryRowContext(ctx, "SELECT COUNT(*), COUNT(CASE WHEN name = 'aggregate_id' THEN 1 END) FROM pragma_table_info('outbox')").Scan(&columns, &aggregateColumns)
 	if err != nil {
 		return err
 	}
+	if columns == 0 || aggregateColumns > 0 {
+		return nil
+	}
 
-	_, err = db.Exec(createOutboxTable)
+	slog.Info("rebuilding legacy outbox table", "database", databasePath)
+	_, err = conn.ExecContext(ctx, rebuildLegacyOutbox)
 	return err
 }
 
-func Run(ctx context.Context, port string) error {
+func initDB() error {
+	var err error
+	db, err = migration.Open(databasePath)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range Migrations() {
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			slog.Info("database migrated", "source", source.Name, "applied", applied)
+		}
+	}
+
+	var duplicates int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orders_duplicates").Scan(&duplicates); err != nil {
+		return err
+	}
+	if duplicates > 0 {
+		slog.Warn("duplicate orders were moved out of orders when order_id became unique, review and delete them", "table", "orders_duplicates", "count", duplicates)
+	}
+
+	outboxStore = outbox.NewSQLStore(db)
+	return nil
+}
+
+func Run(ctx context.Context, port string, relayWakeupURL string) error {
 	if err := initDB(); err != nil {
 		return fmt.Errorf("failed to init database: %w", err)
 	}
 	defer db.Close()
 
-	e := echo.New()
-	e.POST("/finish-order-improved", handleFinishOrder)
-	e.GET("/orders", handleGetOrders)
-	e.GET("/outbox", handleGetOutbox)
+	if relayWakeupURL != "" {
+		outboxNotifier = outbox.NewHTTPNotifier(relayWakeupURL)
+	}
 
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: e,
+		Handler: newServer(),
 	}
 
 	go func() {
@@ -129,141 +173,179 @@ func Run(ctx context.Context, port string) error {
 	return server.Shutdown(context.Background())
 }
 
-func handleFinishOrder(c echo.Context) error {
-	var req OrderRequest
-	if err := c.Bind(&req); err != nil {
-		slog.Error("failed to bind request", "error", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+func newServer() *echo.Echo {
+	e := echo.New()
+	e.POST("/finish-order-improved", handleFinishOrder)
+	e.POST("/orders", handleCreateOrder)
+	for _, transition := range lifecycle.Transitions {
+		e.POST("/orders/:orderId/"+transition.Action, handleOrderTransition(transition.Action))
 	}
+	e.GET("/orders", handleGetOrders)
+	e.GET("/orders/:orderId", handleGetOrder)
+	e.GET("/orders/:orderId/timeline", handleGetOrderTimeline)
+	e.GET("/outbox", handleGetOutbox)
+	e.GET("/outbox/:id", handleGetOutboxMessage)
+	e.POST("/outbox/:id/retry", handleRetryOutboxMessage)
+	e.POST("/outbox/retry-failed", handleRetryFailedOutboxMessages)
+	return e
+}
 
-	slog.Info("processing order request", "orderId", req.OrderID, "userName", req.UserName, "userEmail", req.UserEmail, "deviceId", req.DeviceID)
+func handleFinishOrder(c echo.Context) error {
+	return placeOrder(c, []string{lifecycle.ActionPay, lifecycle.ActionFinish}, func(OrderRecord) (int, interface{}) {
+		return http.StatusOK, map[string]string{"status": "order finished successfully"}
+	})
+}
 
-	if rand.Float32() < 0.1 {
-		slog.Info("random failure occurred during order processing", "orderId", req.OrderID)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "random failure occurred"})
+func createOutboxMessage(ctx context.Context, tx *sql.Tx, aggregateID string, correlationID string, causationID string, payload events.Payload) error {
+	if err := payload.Validate(); err != nil {
+		return err
 	}
 
-	tx, err := db.Begin()
+	message, err := outbox.NewMessage(payload.MessageType(), aggregateID, payload)
 	if err != nil {
-		slog.Error("failed to start transaction", "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+		return err
 	}
-	defer tx.Rollback()
+	message.AggregateType = orderAggregateType
+	message.SchemaVersion = payload.SchemaVersion()
+	message.CorrelationID = correlationID
+	message.CausationID = causationID
+	message.Headers = map[string]string{"X-Source": "order-improved"}
 
-	slog.Info("transaction started", "orderId", req.OrderID)
+	_, err = outbox.Enqueue(ctx, tx, message)
+	return err
+}
 
-	_, err = tx.Exec(
-		"INSERT INTO orders (order_id, user_name, user_email, device_id, status) VALUES (?, ?, ?, ?, ?)",
-		req.OrderID, req.UserName, req.UserEmail, req.DeviceID, "PENDING",
-	)
+func handleGetOrders(c echo.Context) error {
+	query, err := listing.Parse(c.QueryParams(), orderListing)
 	if err != nil {
-		slog.Error("failed to create order", "orderId", req.OrderID, "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	_, err = tx.Exec("UPDATE orders SET status = 'FINISHED', updated_at = CURRENT_TIMESTAMP WHERE order_id = ?", req.OrderID)
+	statement, args := query.SQL("orders", orderColumns)
+	rows, err := db.Query(statement, args...)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update order status"})
+		slog.Error("failed to fetch orders", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch orders"})
 	}
+	defer rows.Close()
 
-	if err := createOutboxMessage(tx, "EMAIL", map[string]interface{}{
-		"recipients": []string{req.UserEmail},
-		"subject":    "Order Completed",
-		"body":       fmt.Sprintf("Your order %s has been completed successfully!", req.OrderID),
-	}); err != nil {
-		slog.Error("failed to create email outbox message", "orderId", req.OrderID, "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create email outbox message"})
+	orders := []OrderRecord{}
+	page := query.Page()
+	for rows.Next() {
+		var key string
+		order, err := scanOrder(rows, &key)
+		if err != nil {
+			slog.Error("failed to scan order", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read orders"})
+		}
+		if !page.Add(key, order.ID) {
+			break
+		}
+		orders = append(orders, order)
 	}
-	slog.Info("[ORDER-" + req.OrderID + "] email outbox message created")
-
-	if err := createOutboxMessage(tx, "NOTIFY", map[string]interface{}{
-		"deviceId": []string{req.DeviceID},
-		"message":  fmt.Sprintf("Order %s completed successfully!", req.OrderID),
-	}); err != nil {
-		slog.Error("failed to create notification outbox message", "orderId", req.OrderID, "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create notification outbox message"})
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read orders", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read orders"})
 	}
-	slog.Info("[ORDER-" + req.OrderID + "] notification outbox message created")
-
-	if err := createOutboxMessage(tx, "ANALYTIC", map[string]interface{}{
-		"event":     "order_completed",
-		"orderId":   req.OrderID,
-		"userEmail": req.UserEmail,
-		"timestamp": time.Now(),
-	}); err != nil {
-		slog.Error("failed to create analytics outbox message", "orderId", req.OrderID, "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create analytics outbox message"})
+
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
+	return c.JSON(http.StatusOK, orders)
+}
+
+func handleGetOrder(c echo.Context) error {
+	orderID := c.Param("orderId")
+	order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order"})
 	}
-	slog.Info("[ORDER-" + req.OrderID + "] analytics outbox message created")
 
-	if err := tx.Commit(); err != nil {
-		slog.Error("failed to commit transaction", "orderId", req.OrderID, "error", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to commit transaction"})
+	messages, err := outboxStore.ListByAggregate(c.Request().Context(), orderID)
+	if err != nil {
+		slog.Error("failed to fetch outbox messages for order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch outbox messages"})
 	}
 
-	slog.Info("order finished successfully with outbox messages", "orderId", req.OrderID)
-	return c.JSON(http.StatusOK, map[string]string{"status": "order finished successfully"})
+	return c.JSON(http.StatusOK, OrderDetail{OrderRecord: order, Outbox: messages})
+}
+
+func scanOrder(row interface{ Scan(...interface{}) error }, extra ...interface{}) (OrderRecord, error) {
+	var order OrderRecord
+	var paidAt sql.NullTime
+	dest := []interface{}{&order.ID, &order.OrderID, &order.UserName, &order.UserEmail, &order.DeviceID, &order.Status, &paidAt, &order.CreatedAt, &order.UpdatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if paidAt.Valid {
+		order.PaidAt = &paidAt.Time
+	}
+	return order, err
 }
 
-func createOutboxMessage(tx *sql.Tx, messageType string, data interface{}) error {
-	jsonData, err := json.Marshal(data)
+func handleGetOutbox(c echo.Context) error {
+	query, err := listing.Parse(c.QueryParams(), outboxListing)
 	if err != nil {
-		return err
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	result, err := tx.Exec(
-		"INSERT INTO outbox (status, type, data) VALUES (?, ?, ?)",
-		"PENDING", messageType, string(jsonData),
-	)
+	messages, next, err := outboxStore.List(c.Request().Context(), query)
 	if err != nil {
-		return err
+		slog.Error("failed to fetch outbox messages", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch outbox messages"})
 	}
 
-	id, _ := result.LastInsertId()
-	slog.Info("outbox message inserted", "id", id, "type", messageType, "data", string(jsonData))
-	return nil
+	listing.SetNext(c.Response().Header(), c.Request().URL, next)
+	return c.JSON(http.StatusOK, messages)
 }
 
-func handleGetOrders(c echo.Context) error {
-	rows, err := db.Query("SELECT id, order_id, user_name, user_email, device_id, status, created_at, updated_at FROM orders ORDER BY created_at DESC")
+func handleGetOutboxMessage(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch orders"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid outbox message id"})
 	}
-	defer rows.Close()
 
-	var orders []OrderRecord
-	for rows.Next() {
-		var order OrderRecord
-		err := rows.Scan(&order.ID, &order.OrderID, &order.UserName, &order.UserEmail, &order.DeviceID, &order.Status, &order.CreatedAt, &order.UpdatedAt)
-		if err != nil {
-			continue
-		}
-		orders = append(orders, order)
+	message, err := outboxStore.Get(c.Request().Context(), id)
+	if errors.Is(err, outbox.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "outbox message not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch outbox message", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch outbox message"})
 	}
 
-	return c.JSON(http.StatusOK, orders)
+	return c.JSON(http.StatusOK, message)
 }
 
-func handleGetOutbox(c echo.Context) error {
-	rows, err := db.Query("SELECT id, status, type, data, created_at, finished_at FROM outbox ORDER BY created_at DESC")
+func handleRetryOutboxMessage(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch outbox messages"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid outbox message id"})
 	}
-	defer rows.Close()
 
-	var messages []OutboxMessage
-	for rows.Next() {
-		var message OutboxMessage
-		var finishedAt sql.NullTime
-		err := rows.Scan(&message.ID, &message.Status, &message.Type, &message.Data, &message.CreatedAt, &finishedAt)
-		if err != nil {
-			continue
-		}
-		if finishedAt.Valid {
-			message.FinishedAt = &finishedAt.Time
-		}
-		messages = append(messages, message)
+	err = outboxStore.Requeue(c.Request().Context(), id)
+	if errors.Is(err, outbox.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if errors.Is(err, outbox.ErrNotRequeueable) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		slog.Error("failed to requeue outbox message", "id", id, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to requeue outbox message"})
 	}
 
-	return c.JSON(http.StatusOK, messages)
+	slog.Info("outbox message requeued", "id", id)
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": "outbox message requeued", "id": id})
+}
+
+func handleRetryFailedOutboxMessages(c echo.Context) error {
+	requeued, err := outboxStore.RequeueFailed(c.Request().Context(), c.QueryParam("type"))
+	if err != nil {
+		slog.Error("failed to requeue failed outbox messages", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to requeue outbox messages"})
+	}
+
+	slog.Info("failed outbox messages requeued", "count", requeued)
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": "failed outbox messages requeued", "requeued": requeued})
 }
@@ -0,0 +1,104 @@
+package orderimproved
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"substack-outbox/idempotency"
+)
+
+func newTestServer(t *testing.T) *echo.Echo {
+	t.Chdir(t.TempDir())
+	if err := initDB(); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newServer()
+}
+
+func postOrder(t *testing.T, e *echo.Echo, path string, req OrderRequest, idempotencyKey string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal order: %v", err)
+	}
+
+	for attempt := 0; attempt < 50; attempt++ {
+		request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if idempotencyKey != "" {
+			request.Header.Set(idempotency.Header, idempotencyKey)
+		}
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusInternalServerError {
+			return recorder
+		}
+	}
+	t.Fatalf("POST %s kept failing", path)
+	return nil
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("count rows: %v", err)
+	}
+	return count
+}
+
+func TestFinishOrderTwice(t *testing.T) {
+	e := newTestServer(t)
+	req := OrderRequest{OrderID: "ORDER-1", UserName: "User1", UserEmail: "user1@example.com", DeviceID: "DEVICE-1"}
+
+	first := postOrder(t, e, "/finish-order-improved", req, "ORDER-1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request: got %d %s, want 200", first.Code, first.Body)
+	}
+
+	replayed := postOrder(t, e, "/finish-order-improved", req, "ORDER-1")
+	if replayed.Code != http.StatusOK {
+		t.Fatalf("retry with the same key: got %d %s, want 200", replayed.Code, replayed.Body)
+	}
+	if replayed.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Errorf("retry with the same key was not marked as replayed")
+	}
+	if strings.TrimSpace(replayed.Body.String()) != strings.TrimSpace(first.Body.String()) {
+		t.Errorf("replayed body %s differs from first body %s", replayed.Body, first.Body)
+	}
+
+	duplicate := postOrder(t, e, "/finish-order-improved", req, "")
+	if duplicate.Code != http.StatusConflict {
+		t.Fatalf("duplicate without key: got %d %s, want 409", duplicate.Code, duplicate.Body)
+	}
+
+	if count := countRows(t, "SELECT COUNT(*) FROM orders WHERE order_id = ?", req.OrderID); count != 1 {
+		t.Errorf("got %d order rows, want 1", count)
+	}
+	if count := countRows(t, "SELECT COUNT(*) FROM outbox WHERE aggregate_id = ?", req.OrderID); count != 6 {
+		t.Errorf("got %d outbox rows, want 6", count)
+	}
+}
+
+func TestCreateOrderTwice(t *testing.T) {
+	e := newTestServer(t)
+	req := OrderRequest{OrderID: "ORDER-1", UserName: "User1", UserEmail: "user1@example.com", DeviceID: "DEVICE-1"}
+
+	if first := postOrder(t, e, "/orders", req, ""); first.Code != http.StatusCreated {
+		t.Fatalf("first request: got %d %s, want 201", first.Code, first.Body)
+	}
+	if duplicate := postOrder(t, e, "/orders", req, ""); duplicate.Code != http.StatusConflict {
+		t.Fatalf("duplicate: got %d %s, want 409", duplicate.Code, duplicate.Body)
+	}
+
+	if count := countRows(t, "SELECT COUNT(*) FROM orders WHERE order_id = ?", req.OrderID); count != 1 {
+		t.Errorf("got %d order rows, want 1", count)
+	}
+	if count := countRows(t, "SELECT COUNT(*) FROM outbox WHERE aggregate_id = ?", req.OrderID); count != 1 {
+		t.Errorf("got %d outbox rows, want 1", count)
+	}
+}
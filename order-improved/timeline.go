@@ -0,0 +1,157 @@
+package orderimproved
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"substack-outbox/outbox"
+)
+
+const orderAggregateType = "order"
+
+const (
+	timelineStatusChanged   = "status_changed"
+	timelineMessageEnqueued = "message_enqueued"
+	timelineDeliveryAttempt = "delivery_attempt"
+)
+
+type TimelineEvent struct {
+	At          time.Time `json:"at"`
+	Kind        string    `json:"kind"`
+	FromStatus  string    `json:"fromStatus,omitempty"`
+	ToStatus    string    `json:"toStatus,omitempty"`
+	OutboxID    int       `json:"outboxId,omitempty"`
+	MessageType string    `json:"messageType,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	Outcome     string    `json:"outcome,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type TimelineMessage struct {
+	ID         int        `json:"id"`
+	MessageID  string     `json:"messageId"`
+	Type       string     `json:"type"`
+	Sequence   int        `json:"sequence"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Outcome    string     `json:"outcome,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type OrderTimeline struct {
+	OrderID  string            `json:"orderId"`
+	Status   string            `json:"status"`
+	Events   []TimelineEvent   `json:"events"`
+	Messages []TimelineMessage `json:"messages"`
+}
+
+func handleGetOrderTimeline(c echo.Context) error {
+	ctx := c.Request().Context()
+	orderID := c.Param("orderId")
+
+	order, err := scanOrder(db.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order"})
+	}
+
+	events, err := statusChanges(orderID)
+	if err != nil {
+		slog.Error("failed to fetch order status history", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order timeline"})
+	}
+
+	messages, err := outboxStore.ListByAggregate(ctx, orderID)
+	if err != nil {
+		slog.Error("failed to fetch outbox messages for order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order timeline"})
+	}
+	attempts, err := outboxStore.AttemptsByAggregate(ctx, orderID)
+	if err != nil {
+		slog.Error("failed to fetch delivery attempts for order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order timeline"})
+	}
+
+	attemptCounts := make(map[int]int, len(messages))
+	for _, attempt := range attempts {
+		if attempt.Outcome != outbox.AttemptRequeued {
+			attemptCounts[attempt.OutboxID]++
+		}
+	}
+
+	types := make(map[int]string, len(messages))
+	timeline := OrderTimeline{OrderID: order.OrderID, Status: order.Status, Messages: []TimelineMessage{}}
+	for _, message := range messages {
+		types[message.ID] = message.Type
+		events = append(events, TimelineEvent{
+			At:          message.OccurredAt,
+			Kind:        timelineMessageEnqueued,
+			OutboxID:    message.ID,
+			MessageType: message.Type,
+		})
+		timeline.Messages = append(timeline.Messages, TimelineMessage{
+			ID:         message.ID,
+			MessageID:  message.MessageID,
+			Type:       message.Type,
+			Sequence:   message.Sequence,
+			Status:     message.Status,
+			Attempts:   attemptCounts[message.ID],
+			Outcome:    deliveryOutcome(message.Status),
+			LastError:  message.LastError,
+			FinishedAt: message.FinishedAt,
+		})
+	}
+	for _, attempt := range attempts {
+		events = append(events, TimelineEvent{
+			At:          attempt.AttemptedAt,
+			Kind:        timelineDeliveryAttempt,
+			OutboxID:    attempt.OutboxID,
+			MessageType: types[attempt.OutboxID],
+			Attempt:     attempt.Attempt,
+			Outcome:     attempt.Outcome,
+			Error:       attempt.Error,
+		})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	timeline.Events = events
+	return c.JSON(http.StatusOK, timeline)
+}
+
+func statusChanges(orderID string) ([]TimelineEvent, error) {
+	rows, err := db.Query("SELECT from_status, to_status, changed_at FROM order_status_history WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []TimelineEvent{}
+	for rows.Next() {
+		var fromStatus sql.NullString
+		event := TimelineEvent{Kind: timelineStatusChanged}
+		if err := rows.Scan(&fromStatus, &event.ToStatus, &event.At); err != nil {
+			return nil, err
+		}
+		event.FromStatus = fromStatus.String
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func deliveryOutcome(status string) string {
+	switch status {
+	case outbox.StatusFinished:
+		return outbox.AttemptDelivered
+	case outbox.StatusFailed:
+		return outbox.AttemptFailed
+	}
+	return ""
+}
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS orders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL,
+	user_name TEXT NOT NULL,
+	user_email TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'CREATED',
+	paid_at DATETIME,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_order_id ON orders (order_id);
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS sagas (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'RUNNING',
+	step INTEGER NOT NULL DEFAULT 0,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sagas_order_id ON sagas (order_id);
+CREATE INDEX IF NOT EXISTS idx_sagas_status_next_attempt ON sagas (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS saga_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	saga_id INTEGER NOT NULL,
+	step TEXT NOT NULL,
+	action TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	outcome TEXT NOT NULL,
+	error TEXT,
+	at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_saga_log_saga_id ON saga_log (saga_id);
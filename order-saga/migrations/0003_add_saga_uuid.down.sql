@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_sagas_uuid;
+
+ALTER TABLE sagas DROP COLUMN uuid;
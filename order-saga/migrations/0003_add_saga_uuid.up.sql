@@ -0,0 +1,5 @@
+ALTER TABLE sagas ADD COLUMN uuid TEXT;
+
+UPDATE sagas SET uuid = lower(hex(randomblob(16))) WHERE uuid IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sagas_uuid ON sagas (uuid);
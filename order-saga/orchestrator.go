@@ -0,0 +1,393 @@
+package ordersaga
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"substack-outbox/events"
+	"substack-outbox/lifecycle"
+	"substack-outbox/outbox"
+)
+
+const (
+	SagaRunning      = "RUNNING"
+	SagaCompensating = "COMPENSATING"
+	SagaCompleted    = "COMPLETED"
+	SagaCompensated  = "COMPENSATED"
+)
+
+const (
+	actionExecute    = "EXECUTE"
+	actionCompensate = "COMPENSATE"
+)
+
+const (
+	outcomeOK      = "OK"
+	outcomeError   = "ERROR"
+	outcomeUnknown = "UNKNOWN"
+)
+
+var errOutcomeUnknown = errors.New("outcome unknown")
+
+const (
+	emailServiceURL        = "http://localhost:8081/send-email"
+	notificationServiceURL = "http://localhost:8082/send-notification"
+	googleAnalyticsURL     = "http://localhost:9000/events"
+)
+
+type StepFunc func(ctx context.Context, client *http.Client, order OrderRecord, idempotencyKey string) error
+
+type Step struct {
+	Name       string
+	Execute    StepFunc
+	Compensate StepFunc
+}
+
+var orderSteps = []Step{
+	{Name: "email", Execute: sendCompletionEmail, Compensate: sendApologyEmail},
+	{Name: "notification", Execute: sendCompletionNotice, Compensate: retractCompletionNotice},
+	{Name: "analytics", Execute: trackCompletion, Compensate: trackCancellation},
+}
+
+type Orchestrator struct {
+	db     *sql.DB
+	steps  []Step
+	cfg    Config
+	client *http.Client
+	wakeup chan struct{}
+}
+
+func NewOrchestrator(db *sql.DB, steps []Step, cfg Config) *Orchestrator {
+	if cfg.MaxStepAttempts <= 0 {
+		cfg.MaxStepAttempts = 3
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.Backoff.Base <= 0 {
+		cfg.Backoff.Base = time.Second
+	}
+	if cfg.StepTimeout <= 0 {
+		cfg.StepTimeout = 10 * time.Second
+	}
+	return &Orchestrator{db: db, steps: steps, cfg: cfg, client: &http.Client{Timeout: cfg.StepTimeout}, wakeup: make(chan struct{}, 1)}
+}
+
+func (o *Orchestrator) Notify() {
+	select {
+	case o.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Orchestrator) Run(ctx context.Context) {
+	var inFlight int
+	err := o.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sagas WHERE status IN (?, ?)", SagaRunning, SagaCompensating).Scan(&inFlight)
+	if err != nil {
+		slog.Error("failed to count in-flight sagas", "error", err)
+	}
+	slog.Info("saga orchestrator started", "in_flight", inFlight, "max_step_attempts", o.cfg.MaxStepAttempts, "step_timeout", o.cfg.StepTimeout, "failure_rate", o.cfg.FailureRate)
+
+	ticker := time.NewTicker(o.cfg.PollInterval)
+	defer ticker.Stop()
+
+	o.processDue(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("saga orchestrator stopped")
+			return
+		case <-ticker.C:
+		case <-o.wakeup:
+		}
+		o.processDue(ctx)
+	}
+}
+
+func (o *Orchestrator) processDue(ctx context.Context) {
+	rows, err := o.db.QueryContext(ctx,
+		"SELECT id FROM sagas WHERE status IN (?, ?) AND next_attempt_at <= datetime('now') ORDER BY id LIMIT 100",
+		SagaRunning, SagaCompensating,
+	)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to fetch due sagas", "error", err)
+		}
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			slog.Error("failed to scan saga id", "error", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		for ctx.Err() == nil {
+			advanced, err := o.advance(ctx, id)
+			if err != nil {
+				slog.Error("failed to advance saga", "sagaId", id, "error", err)
+				break
+			}
+			if !advanced {
+				break
+			}
+		}
+	}
+}
+
+func (o *Orchestrator) advance(ctx context.Context, sagaID int) (bool, error) {
+	saga, err := scanSaga(o.db.QueryRowContext(ctx, "SELECT "+sagaColumns+" FROM sagas WHERE id = ?", sagaID))
+	if err != nil {
+		return false, err
+	}
+	order, err := scanOrder(o.db.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE order_id = ?", saga.OrderID))
+	if err != nil {
+		return false, err
+	}
+
+	switch saga.Status {
+	case SagaRunning:
+		if saga.Step >= len(o.steps) {
+			return false, o.finish(ctx, saga, order, lifecycle.ActionFinish, SagaCompleted)
+		}
+		return o.execute(ctx, saga, order)
+	case SagaCompensating:
+		if saga.Step <= 0 {
+			return false, o.finish(ctx, saga, order, lifecycle.ActionCancel, SagaCompensated)
+		}
+		return o.compensate(ctx, saga, order)
+	}
+	return false, nil
+}
+
+func (o *Orchestrator) execute(ctx context.Context, saga SagaRecord, order OrderRecord) (bool, error) {
+	step := o.steps[saga.Step]
+	attempt := saga.Attempts + 1
+	cause := o.invoke(ctx, step.Name, step.Execute, order, idempotencyKey(saga, step, actionExecute))
+
+	if cause == nil {
+		slog.Info("[ORDER-"+order.OrderID+"] saga step done", "step", step.Name, "attempt", attempt)
+		return true, o.record(ctx, saga, step, actionExecute, attempt, nil,
+			"UPDATE sagas SET step = step + 1, attempts = 0, last_error = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?", saga.ID)
+	}
+
+	if attempt >= o.cfg.MaxStepAttempts {
+		uncertain := errors.Is(cause, errOutcomeUnknown)
+		if !uncertain {
+			err := o.db.QueryRowContext(ctx,
+				"SELECT EXISTS (SELECT 1 FROM saga_log WHERE saga_id = ? AND step = ? AND action = ? AND outcome = ?)",
+				saga.ID, step.Name, actionExecute, outcomeUnknown,
+			).Scan(&uncertain)
+			if err != nil {
+				return false, err
+			}
+		}
+		undo := 0
+		if uncertain {
+			undo = 1
+		}
+		slog.Error("[ORDER-"+order.OrderID+"] saga step gave up, compensating", "step", step.Name, "attempt", attempt, "compensate_failed_step", uncertain, "error", cause)
+		return true, o.record(ctx, saga, step, actionExecute, attempt, cause,
+			"UPDATE sagas SET status = ?, step = step + ?, attempts = 0, last_error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", SagaCompensating, undo, cause.Error(), saga.ID)
+	}
+
+	delay := o.cfg.Backoff.Delay(attempt)
+	slog.Info("[ORDER-"+order.OrderID+"] saga step failed, retrying", "step", step.Name, "attempt", attempt, "retry_in", delay, "error", cause)
+	return false, o.record(ctx, saga, step, actionExecute, attempt, cause,
+		"UPDATE sagas SET attempts = ?, last_error = ?, next_attempt_at = datetime('now', ?), updated_at = CURRENT_TIMESTAMP WHERE id = ?", attempt, cause.Error(), outbox.SecondsModifier(delay), saga.ID)
+}
+
+func (o *Orchestrator) compensate(ctx context.Context, saga SagaRecord, order OrderRecord) (bool, error) {
+	step := o.steps[saga.Step-1]
+	if step.Compensate == nil {
+		_, err := o.db.ExecContext(ctx, "UPDATE sagas SET step = step - 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?", saga.ID)
+		return true, err
+	}
+
+	attempt := saga.Attempts + 1
+	cause := o.invoke(ctx, step.Name, step.Compensate, order, idempotencyKey(saga, step, actionCompensate))
+
+	if cause == nil {
+		slog.Info("[ORDER-"+order.OrderID+"] saga step compensated", "step", step.Name, "attempt", attempt)
+		return true, o.record(ctx, saga, step, actionCompensate, attempt, nil,
+			"UPDATE sagas SET step = step - 1, attempts = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?", saga.ID)
+	}
+
+	delay := o.cfg.Backoff.Delay(attempt)
+	slog.Info("[ORDER-"+order.OrderID+"] saga compensation failed, retrying", "step", step.Name, "attempt", attempt, "retry_in", delay, "error", cause)
+	return false, o.record(ctx, saga, step, actionCompensate, attempt, cause,
+		"UPDATE sagas SET attempts = ?, next_attempt_at = datetime('now', ?), updated_at = CURRENT_TIMESTAMP WHERE id = ?", attempt, outbox.SecondsModifier(delay), saga.ID)
+}
+
+func (o *Orchestrator) finish(ctx context.Context, saga SagaRecord, order OrderRecord, action string, status string) error {
+	transition, err := lifecycle.Apply(lifecycle.State{Status: order.Status, Paid: order.PaidAt != nil}, action)
+	if err != nil {
+		return err
+	}
+
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE orders SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE order_id = ?", transition.To, order.OrderID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE sagas SET status = ?, updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP WHERE id = ?", status, saga.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("[ORDER-"+order.OrderID+"] saga "+status, "orderStatus", transition.To)
+	return nil
+}
+
+func (o *Orchestrator) record(ctx context.Context, saga SagaRecord, step Step, action string, attempt int, cause error, update string, args ...interface{}) error {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	outcome, errorText := outcomeOK, sql.NullString{}
+	if cause != nil {
+		outcome, errorText = outcomeError, sql.NullString{String: cause.Error(), Valid: true}
+		if errors.Is(cause, errOutcomeUnknown) {
+			outcome = outcomeUnknown
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO saga_log (saga_id, step, action, attempt, outcome, error) VALUES (?, ?, ?, ?, ?, ?)",
+		saga.ID, step.Name, action, attempt, outcome, errorText,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, update, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (o *Orchestrator) invoke(ctx context.Context, name string, fn StepFunc, order OrderRecord, key string) error {
+	if rand.Float64() < o.cfg.FailureRate {
+		return fmt.Errorf("random failure in %s step", name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.cfg.StepTimeout)
+	defer cancel()
+	return fn(ctx, o.client, order, key)
+}
+
+func idempotencyKey(saga SagaRecord, step Step, action string) string {
+	return fmt.Sprintf("saga-%s-%s-%s-%s", saga.OrderID, saga.UUID, step.Name, action)
+}
+
+func completionEmail(order OrderRecord) events.Email {
+	return events.Email{
+		Recipients: []string{order.UserEmail},
+		Subject:    "Order Completed",
+		Body:       fmt.Sprintf("Your order %s has been completed successfully!", order.OrderID),
+	}
+}
+
+func completionNotice(order OrderRecord) events.Notify {
+	return events.Notify{
+		DeviceID: []string{order.DeviceID},
+		Message:  fmt.Sprintf("Order %s completed successfully!", order.OrderID),
+	}
+}
+
+func sendCompletionEmail(ctx context.Context, client *http.Client, order OrderRecord, key string) error {
+	return postJSON(ctx, client, emailServiceURL, order.OrderID, key, completionEmail(order))
+}
+
+func sendApologyEmail(ctx context.Context, client *http.Client, order OrderRecord, key string) error {
+	return postJSON(ctx, client, emailServiceURL, order.OrderID, key, events.Email{
+		Recipients: []string{order.UserEmail},
+		Subject:    "Order Cancelled",
+		Body:       fmt.Sprintf("Your order %s has been cancelled. We apologize for the inconvenience. Please disregard the earlier order confirmation.", order.OrderID),
+	})
+}
+
+func sendCompletionNotice(ctx context.Context, client *http.Client, order OrderRecord, key string) error {
+	return postJSON(ctx, client, notificationServiceURL, order.OrderID, key, completionNotice(order))
+}
+
+func retractCompletionNotice(ctx context.Context, client *http.Client, order OrderRecord, key string) error {
+	return postJSON(ctx, client, notificationServiceURL, order.OrderID, key, events.Notify{
+		DeviceID: []string{order.DeviceID},
+		Message:  fmt.Sprintf("Order %s was cancelled, please disregard the earlier completion notice.", order.OrderID),
+	})
+}
+
+func trackCompletion(ctx context.Context, client *http.Client, order OrderRecord, key string) error {
+	return trackOrderEvent(ctx, client, order, key, "order_completed")
+}
+
+func trackCancellation(ctx context.Context, client *http.Client, order OrderRecord, key string) error {
+	return trackOrderEvent(ctx, client, order, key, "order_cancelled")
+}
+
+func trackOrderEvent(ctx context.Context, client *http.Client, order OrderRecord, key string, event string) error {
+	payload := events.Analytic{Event: event, OrderID: order.OrderID, UserEmail: order.UserEmail, Timestamp: time.Now()}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, client, googleAnalyticsURL, order.OrderID, key, map[string]interface{}{
+		"messageId":     key,
+		"type":          payload.MessageType(),
+		"schemaVersion": payload.SchemaVersion(),
+		"correlationId": order.OrderID,
+		"payload":       json.RawMessage(data),
+	})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, orderID string, key string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	req.Header.Set("X-Correlation-Id", orderID)
+
+	resp, err := client.Do(req)
+	var dialErr *net.OpError
+	if errors.As(err, &dialErr) && dialErr.Op == "dial" {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errOutcomeUnknown, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status: %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package ordersaga
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"substack-outbox/events"
+	"substack-outbox/idempotency"
+	"substack-outbox/lifecycle"
+	"substack-outbox/listing"
+	"substack-outbox/migration"
+	"substack-outbox/outbox"
+)
+
+type Config struct {
+	Port            string
+	FailureRate     float64
+	MaxStepAttempts int
+	Backoff         outbox.BackoffPolicy
+	PollInterval    time.Duration
+	StepTimeout     time.Duration
+}
+
+type OrderRequest struct {
+	OrderID   string `json:"orderId"`
+	UserName  string `json:"userName"`
+	UserEmail string `json:"userEmail"`
+	DeviceID  string `json:"deviceId"`
+}
+
+type OrderRecord struct {
+	ID        int        `json:"id"`
+	OrderID   string     `json:"orderId"`
+	UserName  string     `json:"userName"`
+	UserEmail string     `json:"userEmail"`
+	DeviceID  string     `json:"deviceId"`
+	Status    string     `json:"status"`
+	PaidAt    *time.Time `json:"paidAt,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type SagaRecord struct {
+	ID            int        `json:"id"`
+	UUID          string     `json:"uuid"`
+	OrderID       string     `json:"orderId"`
+	Status        string     `json:"status"`
+	Step          int        `json:"step"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"lastError,omitempty"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+}
+
+type SagaLogEntry struct {
+	Step    string    `json:"step"`
+	Action  string    `json:"action"`
+	Attempt int       `json:"attempt"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type OrderDetail struct {
+	OrderRecord
+	Saga *SagaRecord `json:"saga"`
+}
+
+type SagaDetail struct {
+	SagaRecord
+	Steps []string       `json:"steps"`
+	Log   []SagaLogEntry `json:"log"`
+}
+
+const databasePath = "./order_saga.db"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var db *sql.DB
+
+var orchestrator *Orchestrator
+
+const orderColumns = "id, order_id, user_name, user_email, device_id, status, paid_at, created_at, updated_at"
+
+const sagaColumns = "id, uuid, order_id, status, step, attempts, last_error, next_attempt_at, created_at, updated_at, finished_at"
+
+var orderListing = listing.Spec{
+	Sorts:      []string{"created_at", "updated_at"},
+	Filters:    map[string]string{"status": "status", "orderId": "order_id"},
+	TimeColumn: "created_at",
+}
+
+var sagaListing = listing.Spec{
+	Sorts:      []string{"created_at", "updated_at"},
+	Filters:    map[string]string{"status": "status", "orderId": "order_id"},
+	TimeColumn: "created_at",
+}
+
+func Migrations() []migration.Source {
+	return []migration.Source{
+		{Name: "order-saga", Path: databasePath, FS: migrationFiles, Dir: "migrations"},
+	}
+}
+
+func initDB() error {
+	var err error
+	db, err = migration.Open(databasePath)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range Migrations() {
+		applied, err := migration.Up(db, source)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			slog.Info("database migrated", "source", source.Name, "applied", applied)
+		}
+	}
+	return nil
+}
+
+func Run(ctx context.Context, cfg Config) error {
+	if err := initDB(); err != nil {
+		return fmt.Errorf("failed to init database: %w", err)
+	}
+	defer db.Close()
+
+	orchestrator = NewOrchestrator(db, orderSteps, cfg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		orchestrator.Run(ctx)
+	}()
+	defer func() { <-done }()
+
+	e := echo.New()
+	e.POST("/finish-order-saga", handleFinishOrder)
+	e.GET("/orders", handleGetOrders)
+	e.GET("/orders/:orderId", handleGetOrder)
+	e.GET("/sagas", handleGetSagas)
+	e.GET("/sagas/:orderId", handleGetSaga)
+
+	server := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: e,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("server error", "error", err)
+		}
+	}()
+
+	slog.Info("saga order service started", "port", cfg.Port)
+
+	<-ctx.Done()
+	return server.Shutdown(context.Background())
+}
+
+func handleFinishOrder(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req OrderRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if req.OrderID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "orderId is required"})
+	}
+
+	order := OrderRecord{OrderID: req.OrderID, UserEmail: req.UserEmail, DeviceID: req.DeviceID}
+	for _, payload := range []events.Payload{completionEmail(order), completionNotice(order)} {
+		if err := payload.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO orders (order_id, user_name, user_email, device_id, status, paid_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		req.OrderID, req.UserName, req.UserEmail, req.DeviceID, lifecycle.StatusPaid,
+	)
+	if idempotency.IsUniqueViolation(err) {
+		slog.Info("[ORDER-" + req.OrderID + "] rejected duplicate order")
+		return c.JSON(http.StatusConflict, map[string]string{"error": "order already exists", "orderId": req.OrderID})
+	}
+	if err != nil {
+		slog.Error("[ORDER-"+req.OrderID+"] failed to create order", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
+	}
+
+	var sagaID int
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO sagas (uuid, order_id, status) VALUES (lower(hex(randomblob(16))), ?, ?) RETURNING id",
+		req.OrderID, SagaRunning,
+	).Scan(&sagaID)
+	if err != nil {
+		slog.Error("[ORDER-"+req.OrderID+"] failed to start saga", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start saga"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to commit transaction"})
+	}
+
+	orchestrator.Notify()
+
+	slog.Info("[ORDER-"+req.OrderID+"] order paid, saga started", "sagaId", sagaID)
+	return c.JSON(http.StatusAccepted, map[string]interface{}{"status": "order accepted", "orderId": req.OrderID, "sagaId": sagaID})
+}
+
+func handleGetOrders(c echo.Context) error {
+	query, err := listing.Parse(c.QueryParams(), orderListing)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	statement, args := query.SQL("orders", orderColumns)
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		slog.Error("failed to fetch orders", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch orders"})
+	}
+	defer rows.Close()
+
+	orders := []OrderRecord{}
+	page := query.Page()
+	for rows.Next() {
+		var key string
+		order, err := scanOrder(rows, &key)
+		if err != nil {
+			slog.Error("failed to scan order", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read orders"})
+		}
+		if !page.Add(key, order.ID) {
+			break
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read orders", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read orders"})
+	}
+
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
+	return c.JSON(http.StatusOK, orders)
+}
+
+func handleGetOrder(c echo.Context) error {
+	orderID := c.Param("orderId")
+	order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch order", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch order"})
+	}
+
+	detail := OrderDetail{OrderRecord: order}
+	saga, err := scanSaga(db.QueryRow("SELECT "+sagaColumns+" FROM sagas WHERE order_id = ?", orderID))
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("failed to fetch saga", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch saga"})
+	}
+	if err == nil {
+		detail.Saga = &saga
+	}
+
+	return c.JSON(http.StatusOK, detail)
+}
+
+func handleGetSagas(c echo.Context) error {
+	query, err := listing.Parse(c.QueryParams(), sagaListing)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	statement, args := query.SQL("sagas", sagaColumns)
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		slog.Error("failed to fetch sagas", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch sagas"})
+	}
+	defer rows.Close()
+
+	sagas := []SagaRecord{}
+	page := query.Page()
+	for rows.Next() {
+		var key string
+		saga, err := scanSaga(rows, &key)
+		if err != nil {
+			slog.Error("failed to scan saga", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read sagas"})
+		}
+		if !page.Add(key, saga.ID) {
+			break
+		}
+		sagas = append(sagas, saga)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read sagas", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read sagas"})
+	}
+
+	listing.SetNext(c.Response().Header(), c.Request().URL, page.Next())
+	return c.JSON(http.StatusOK, sagas)
+}
+
+func handleGetSaga(c echo.Context) error {
+	orderID := c.Param("orderId")
+	saga, err := scanSaga(db.QueryRow("SELECT "+sagaColumns+" FROM sagas WHERE order_id = ?", orderID))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "saga not found"})
+	}
+	if err != nil {
+		slog.Error("failed to fetch saga", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch saga"})
+	}
+
+	log, err := sagaLog(saga.ID)
+	if err != nil {
+		slog.Error("failed to fetch saga log", "orderId", orderID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch saga log"})
+	}
+
+	detail := SagaDetail{SagaRecord: saga, Log: log}
+	for _, step := range orderSteps {
+		detail.Steps = append(detail.Steps, step.Name)
+	}
+	return c.JSON(http.StatusOK, detail)
+}
+
+func sagaLog(sagaID int) ([]SagaLogEntry, error) {
+	rows, err := db.Query("SELECT step, action, attempt, outcome, error, at FROM saga_log WHERE saga_id = ? ORDER BY id", sagaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []SagaLogEntry{}
+	for rows.Next() {
+		var entry SagaLogEntry
+		var errorText sql.NullString
+		if err := rows.Scan(&entry.Step, &entry.Action, &entry.Attempt, &entry.Outcome, &errorText, &entry.At); err != nil {
+			return nil, err
+		}
+		entry.Error = errorText.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func scanOrder(row interface{ Scan(...interface{}) error }, extra ...interface{}) (OrderRecord, error) {
+	var order OrderRecord
+	var paidAt sql.NullTime
+	dest := []interface{}{&order.ID, &order.OrderID, &order.UserName, &order.UserEmail, &order.DeviceID, &order.Status, &paidAt, &order.CreatedAt, &order.UpdatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if paidAt.Valid {
+		order.PaidAt = &paidAt.Time
+	}
+	return order, err
+}
+
+func scanSaga(row interface{ Scan(...interface{}) error }, extra ...interface{}) (SagaRecord, error) {
+	var saga SagaRecord
+	var lastError sql.NullString
+	var finishedAt sql.NullTime
+	dest := []interface{}{&saga.ID, &saga.UUID, &saga.OrderID, &saga.Status, &saga.Step, &saga.Attempts, &lastError, &saga.NextAttemptAt, &saga.CreatedAt, &saga.UpdatedAt, &finishedAt}
+	err := row.Scan(append(dest, extra...)...)
+	saga.LastError = lastError.String
+	if finishedAt.Valid {
+		saga.FinishedAt = &finishedAt.Time
+	}
+	return saga, err
+}
@@ -0,0 +1,21 @@
+package outboxworker
+
+import "substack-outbox/outbox"
+
+type OutboxMessage = outbox.Message
+
+type Handler = outbox.Handler
+
+type HandlerFunc = outbox.HandlerFunc
+
+func Register(messageType string, handler Handler) {
+	outbox.Register(messageType, handler)
+}
+
+func Lookup(messageType string) (Handler, bool) {
+	return outbox.Lookup(messageType)
+}
+
+func RegisteredTypes() []string {
+	return outbox.RegisteredTypes()
+}
@@ -1,236 +1,121 @@
 package outboxworker
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
-	"strconv"
-	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"substack-outbox/migration"
+	"substack-outbox/outbox"
 )
 
-type OutboxMessage struct {
-	ID         int        `json:"id"`
-	Status     string     `json:"status"`
-	Type       string     `json:"type"`
-	Data       string     `json:"data"`
-	CreatedAt  time.Time  `json:"created_at"`
-	FinishedAt *time.Time `json:"finished_at,omitempty"`
+type Config struct {
+	outbox.RelayConfig
+	FailureRate float64
+	WakeupAddr  string
+	Janitor     outbox.JanitorConfig
 }
 
+const databasePath = "./order_improved.db"
+
 var db *sql.DB
 
 func initDB() error {
 	var err error
-	db, err = sql.Open("sqlite3", "./order_improved.db")
-	if err != nil {
-		return err
-	}
-
-	_, err = db.Exec("PRAGMA journal_mode=WAL")
+	db, err = migration.Open(databasePath)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("PRAGMA busy_timeout=5000")
+	var tableCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'outbox'").Scan(&tableCount)
 	if err != nil {
 		return err
 	}
-
-	_, err = db.Exec("DROP TABLE IF EXISTS outbox")
-	if err != nil {
-		return err
+	if tableCount == 0 {
+		slog.Warn("outbox table not found, start order-improved or run `go run cmd/main.go migrate up order-improved`", "database", databasePath)
 	}
-
-	createOutboxTable := `
-	CREATE TABLE outbox (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		status TEXT NOT NULL DEFAULT 'PENDING',
-		type TEXT NOT NULL,
-		data TEXT NOT NULL,
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		finished_at DATETIME
-	);`
-
-	_, err = db.Exec(createOutboxTable)
-	return err
+	return nil
 }
 
-func Run(ctx context.Context, cronPeriod string) error {
+func Run(ctx context.Context, cfg Config) error {
 	if err := initDB(); err != nil {
 		return fmt.Errorf("failed to init database: %w", err)
 	}
 	defer db.Close()
 
-	cronPeriodInt, _ := strconv.Atoi(cronPeriod)
-	ticker := time.NewTicker(time.Duration(cronPeriodInt) * time.Second)
-	defer ticker.Stop()
-
-	slog.Info("outbox worker started", "cron_period", cronPeriod)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			processOutboxMessages()
-		}
+	source := cfg.Registry
+	if source == nil {
+		source = outbox.DefaultRegistry
 	}
-}
-
-func processOutboxMessages() {
-	slog.Info("processing outbox messages")
+	cfg.Registry = withSimulatedFailures(source, cfg.FailureRate)
 
-	countQuery := "SELECT COUNT(*) FROM outbox WHERE status = 'PENDING'"
-	var count int
-	err := db.QueryRow(countQuery).Scan(&count)
-	if err != nil {
-		slog.Error("failed to count pending outbox messages", "error", err)
-		return
-	}
-	slog.Info("found pending outbox messages", "count", count)
+	slog.Info("outbox worker started", "database", databasePath, "failure_rate", cfg.FailureRate)
 
-	if count == 0 {
-		slog.Info("no pending messages to process")
-		return
-	}
+	store := outbox.NewSQLStore(db)
+	relay := outbox.NewRelay(store, cfg.RelayConfig)
 
-	slog.Info("sample message data:")
-	sampleQuery := "SELECT id, type, data FROM outbox WHERE status = 'PENDING' LIMIT 1"
-	var sampleID int
-	var sampleType, sampleData string
-	err = db.QueryRow(sampleQuery).Scan(&sampleID, &sampleType, &sampleData)
-	if err != nil {
-		slog.Error("failed to get sample message", "error", err)
-	} else {
-		slog.Info("sample message", "id", sampleID, "type", sampleType, "data", sampleData)
-	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	rows, err := db.Query("SELECT id, status, type, data, created_at FROM outbox WHERE status = 'PENDING'")
-	if err != nil {
-		slog.Error("failed to query pending outbox messages", "error", err)
-		return
+	if cfg.Janitor.Retention > 0 {
+		janitor := outbox.NewJanitor(store, cfg.Janitor)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			janitor.Run(ctx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
 	}
-	defer rows.Close()
-
-	processedCount := 0
-	for rows.Next() {
-		var message OutboxMessage
-		err := rows.Scan(&message.ID, &message.Status, &message.Type, &message.Data, &message.CreatedAt)
-		if err != nil {
-			slog.Error("failed to scan message", "error", err)
-			continue
-		}
-
-		slog.Info("processing outbox message", "id", message.ID, "type", message.Type, "data", string(message.Data))
 
-		if rand.Float32() < 0.3 {
-			slog.Error("random failure occurred, message will be picked up later", "id", message.ID, "type", message.Type)
-			continue
-		}
-
-		if err := processMessage(message); err != nil {
-			slog.Error("failed to process outbox message", "id", message.ID, "type", message.Type, "error", err)
-			continue
-		}
-
-		_, err = db.Exec("UPDATE outbox SET status = 'FINISHED', finished_at = CURRENT_TIMESTAMP WHERE id = ?", message.ID)
-		if err != nil {
-			slog.Error("failed to update outbox message status", "id", message.ID, "error", err)
-		} else {
-			processedCount++
-			slog.Info("outbox message processed successfully", "id", message.ID, "type", message.Type)
-		}
+	if cfg.WakeupAddr != "" {
+		server := startWakeupServer(cfg.WakeupAddr, relay)
+		defer server.Shutdown(context.Background())
 	}
 
-	slog.Info("outbox processing completed", "total_found", count, "processed", processedCount)
+	return relay.Run(ctx)
 }
 
-func processMessage(message OutboxMessage) error {
-	switch message.Type {
-	case "EMAIL":
-		return processEmailMessage(message)
-	case "NOTIFY":
-		return processNotificationMessage(message)
-	case "ANALYTIC":
-		return processAnalyticsMessage(message)
-	default:
-		return fmt.Errorf("unknown message type: %s", message.Type)
-	}
-}
-
-func processEmailMessage(message OutboxMessage) error {
-	var emailData map[string]interface{}
-	if err := json.Unmarshal([]byte(message.Data), &emailData); err != nil {
-		return fmt.Errorf("failed to unmarshal email data: %w", err)
-	}
-
-	slog.Info("processing email message", "recipients", emailData["recipients"], "subject", emailData["subject"])
+func startWakeupServer(addr string, relay *outbox.Relay) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/wakeup", outbox.WakeupHandler(relay))
 
-	jsonData, _ := json.Marshal(emailData)
-	resp, err := http.Post("http://localhost:8081/send-email", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to call email service: %w", err)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("email service returned status: %d", resp.StatusCode)
-	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("wakeup server error", "error", err)
+		}
+	}()
 
-	return nil
+	slog.Info("outbox worker listening for wakeups", "addr", addr)
+	return server
 }
 
-func processNotificationMessage(message OutboxMessage) error {
-	var notificationData map[string]interface{}
-	if err := json.Unmarshal([]byte(message.Data), &notificationData); err != nil {
-		return fmt.Errorf("failed to unmarshal notification data: %w", err)
+func withSimulatedFailures(source *outbox.Registry, failureRate float64) *outbox.Registry {
+	registry := outbox.NewRegistry()
+	for _, messageType := range source.Types() {
+		handler, _ := source.Lookup(messageType)
+		registry.Register(messageType, simulatedFailureHandler(handler, failureRate))
 	}
-
-	slog.Info("processing notification message", "deviceId", notificationData["deviceId"], "message", notificationData["message"])
-
-	jsonData, _ := json.Marshal(notificationData)
-	resp, err := http.Post("http://localhost:8082/send-notification", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to call notification service: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("notification service returned status: %d", resp.StatusCode)
-	}
-
-	return nil
+	return registry
 }
 
-func processAnalyticsMessage(message OutboxMessage) error {
-	var analyticsData map[string]interface{}
-	if err := json.Unmarshal([]byte(message.Data), &analyticsData); err != nil {
-		return fmt.Errorf("failed to unmarshal analytics data: %w", err)
-	}
-
-	slog.Info("processing analytics message", "event", analyticsData["event"], "orderId", analyticsData["orderId"])
-
-	payloadData := map[string]interface{}{
-		"payload": analyticsData,
-	}
-
-	jsonData, _ := json.Marshal(payloadData)
-	resp, err := http.Post("http://localhost:9000/events", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to call google analytics: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("google analytics returned status: %d", resp.StatusCode)
-	}
-
-	return nil
+func simulatedFailureHandler(handler outbox.Handler, failureRate float64) outbox.Handler {
+	return outbox.HandlerFunc(func(ctx context.Context, message outbox.Message) error {
+		if rand.Float64() < failureRate {
+			slog.Error("random failure occurred, message will be picked up later", "id", message.ID, "type", message.Type)
+			return fmt.Errorf("random failure occurred")
+		}
+		return handler.Handle(ctx, message)
+	})
 }
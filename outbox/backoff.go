@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type BackoffPolicy struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+}
+
+func DefaultBackoffPolicy() BackoffPolicy {
+	return BackoffPolicy{
+		Base:       5 * time.Second,
+		Multiplier: 2,
+		Max:        5 * time.Minute,
+		Jitter:     0.2,
+	}
+}
+
+func (p BackoffPolicy) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(p.Base) * math.Pow(p.Multiplier, float64(attempts-1))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+func (cfg RelayConfig) backoffFor(messageType string) BackoffPolicy {
+	if policy, ok := cfg.TypeBackoff[messageType]; ok {
+		return policy
+	}
+	return cfg.Backoff
+}
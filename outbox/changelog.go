@@ -0,0 +1,79 @@
+package outbox
+
+import (
+	"context"
+	"time"
+)
+
+type Change struct {
+	Seq       int64
+	OutboxID  int
+	Operation string
+}
+
+type ChangeLog interface {
+	Subscribe(ctx context.Context, consumer string) (int64, error)
+	ChangesSince(ctx context.Context, afterSeq int64, limit int) ([]Change, error)
+	ClaimIDs(ctx context.Context, workerID string, ids []int, typeLimits map[string]int, lease time.Duration) ([]Message, error)
+	Commit(ctx context.Context, consumer string, seq int64) error
+}
+
+func (s *SQLStore) Subscribe(ctx context.Context, consumer string) (int64, error) {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO outbox_cdc_offsets (consumer, last_seq) SELECT ?, COALESCE(MAX(seq), 0) FROM outbox_changes WHERE true ON CONFLICT (consumer) DO NOTHING",
+		consumer,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastSeq int64
+	err = s.db.QueryRowContext(ctx, "SELECT last_seq FROM outbox_cdc_offsets WHERE consumer = ?", consumer).Scan(&lastSeq)
+	return lastSeq, err
+}
+
+func (s *SQLStore) ChangesSince(ctx context.Context, afterSeq int64, limit int) ([]Change, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT seq, outbox_id, operation FROM outbox_changes WHERE seq > ? ORDER BY seq LIMIT ?", afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var change Change
+		if err := rows.Scan(&change.Seq, &change.OutboxID, &change.Operation); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (s *SQLStore) ClaimIDs(ctx context.Context, workerID string, ids []int, typeLimits map[string]int, lease time.Duration) ([]Message, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	return s.claim(ctx, workerID, lease, ids, len(ids), typeLimits)
+}
+
+func (s *SQLStore) Commit(ctx context.Context, consumer string, seq int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE outbox_cdc_offsets SET last_seq = ?, updated_at = CURRENT_TIMESTAMP WHERE consumer = ? AND last_seq < ?", seq, consumer, seq)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM outbox_changes WHERE seq <= (SELECT MIN(last_seq) FROM outbox_cdc_offsets)")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,30 @@
+package outbox
+
+import "errors"
+
+var (
+	ErrNotFound       = errors.New("outbox message not found")
+	ErrNotRequeueable = errors.New("outbox message cannot be requeued")
+	ErrLeaseLost      = errors.New("outbox message lease lost")
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var target *permanentError
+	return errors.As(err, &target)
+}
@@ -0,0 +1,70 @@
+package outbox
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+type Handler interface {
+	Handle(ctx context.Context, message Message) error
+}
+
+type HandlerFunc func(ctx context.Context, message Message) error
+
+func (f HandlerFunc) Handle(ctx context.Context, message Message) error {
+	return f(ctx, message)
+}
+
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]Handler)}
+}
+
+func (r *Registry) Register(messageType string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if handler == nil {
+		panic("outbox: Register handler is nil for type " + messageType)
+	}
+	r.handlers[messageType] = handler
+}
+
+func (r *Registry) Lookup(messageType string) (Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handler, ok := r.handlers[messageType]
+	return handler, ok
+}
+
+func (r *Registry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]string, 0, len(r.handlers))
+	for messageType := range r.handlers {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func Register(messageType string, handler Handler) {
+	DefaultRegistry.Register(messageType, handler)
+}
+
+func Lookup(messageType string) (Handler, bool) {
+	return DefaultRegistry.Lookup(messageType)
+}
+
+func RegisteredTypes() []string {
+	return DefaultRegistry.Types()
+}
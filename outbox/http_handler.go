@@ -0,0 +1,134 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+type HTTPHandlerConfig struct {
+	URL          string
+	Method       string
+	Headers      map[string]string
+	BodyTemplate string
+	Timeout      time.Duration
+}
+
+type HTTPHandler struct {
+	url      string
+	method   string
+	headers  map[string]string
+	template *template.Template
+	client   *http.Client
+}
+
+type httpTemplateData struct {
+	ID            int
+	MessageID     string
+	Type          string
+	SchemaVersion int
+	Data          string
+	Envelope      string
+}
+
+func NewHTTPHandler(cfg HTTPHandlerConfig) (*HTTPHandler, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("http handler url is required")
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	if cfg.BodyTemplate == "" {
+		cfg.BodyTemplate = "{{.Data}}"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	tmpl, err := template.New(cfg.URL).Parse(cfg.BodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %w", err)
+	}
+
+	return &HTTPHandler{
+		url:      cfg.URL,
+		method:   cfg.Method,
+		headers:  cfg.Headers,
+		template: tmpl,
+		client:   &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+func (h *HTTPHandler) Handle(ctx context.Context, message Message) error {
+	if !json.Valid(message.Data) {
+		return Permanent(fmt.Errorf("invalid %s data: not valid json", message.Type))
+	}
+
+	envelope, err := json.Marshal(message.Envelope())
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to marshal %s envelope: %w", message.Type, err))
+	}
+
+	var body bytes.Buffer
+	data := httpTemplateData{
+		ID:            message.ID,
+		MessageID:     message.MessageID,
+		Type:          message.Type,
+		SchemaVersion: message.SchemaVersion,
+		Data:          string(message.Data),
+		Envelope:      string(envelope),
+	}
+	if err := h.template.Execute(&body, data); err != nil {
+		return Permanent(fmt.Errorf("failed to render %s body: %w", message.Type, err))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, h.method, h.url, &body)
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to build %s request: %w", message.Type, err))
+	}
+	for key, value := range message.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", message.IdempotencyKey)
+	req.Header.Set("X-Message-Id", message.MessageID)
+	req.Header.Set("X-Message-Type", message.Type)
+	req.Header.Set("X-Schema-Version", strconv.Itoa(message.SchemaVersion))
+	req.Header.Set("X-Occurred-At", message.OccurredAt.UTC().Format(time.RFC3339Nano))
+	if message.CorrelationID != "" {
+		req.Header.Set("X-Correlation-Id", message.CorrelationID)
+	}
+	if message.CausationID != "" {
+		req.Header.Set("X-Causation-Id", message.CausationID)
+	}
+	if message.AggregateID != "" {
+		req.Header.Set("X-Aggregate-Type", message.AggregateType)
+		req.Header.Set("X-Aggregate-Id", message.AggregateID)
+	}
+	for key, value := range h.headers {
+		req.Header.Set(key, value)
+	}
+
+	slog.Info("forwarding outbox message", "id", message.ID, "message_id", message.MessageID, "type", message.Type, "schema_version", message.SchemaVersion, "method", h.method, "url", h.url)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", h.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(fmt.Errorf("%s rejected message with status: %d", h.url, resp.StatusCode))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status: %d", h.url, resp.StatusCode)
+	}
+
+	return nil
+}
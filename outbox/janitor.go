@@ -0,0 +1,209 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Archiver interface {
+	Archive(ctx context.Context, tx *sql.Tx, messages []Message) error
+}
+
+type TableArchiver struct{}
+
+func (TableArchiver) Archive(ctx context.Context, tx *sql.Tx, messages []Message) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO outbox_archive ("+messageColumns+") VALUES ("+strings.TrimSuffix(strings.Repeat("?, ", strings.Count(messageColumns, ",")+1), ", ")+")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, message := range messages {
+		headers, err := json.Marshal(message.Headers)
+		if err != nil {
+			return err
+		}
+		var sequence interface{}
+		if message.AggregateID != "" {
+			sequence = message.Sequence
+		}
+		_, err = stmt.ExecContext(ctx,
+			message.ID, message.MessageID, message.Status, message.Type, message.SchemaVersion, nullString(message.CorrelationID), nullString(message.CausationID), message.OccurredAt, string(headers), string(message.Data),
+			message.IdempotencyKey, nullString(message.AggregateType), nullString(message.AggregateID), nullString(message.Stream), sequence, message.Attempts, nullString(message.LastError), message.NextAttemptAt, nullString(message.LockedBy), message.LockedUntil, message.CreatedAt, message.FinishedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type FileArchiver struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewFileArchiver(path string) *FileArchiver {
+	return &FileArchiver{Path: path}
+}
+
+func (a *FileArchiver) Archive(ctx context.Context, tx *sql.Tx, messages []Message) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, message := range messages {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+type JanitorConfig struct {
+	Retention  time.Duration
+	Interval   time.Duration
+	BatchSize  int
+	BatchPause time.Duration
+	Archiver   Archiver
+}
+
+type Janitor struct {
+	store *SQLStore
+	cfg   JanitorConfig
+}
+
+func NewJanitor(store *SQLStore, cfg JanitorConfig) *Janitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.BatchPause <= 0 {
+		cfg.BatchPause = 50 * time.Millisecond
+	}
+	return &Janitor{store: store, cfg: cfg}
+}
+
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+
+	slog.Info("outbox janitor started", "retention", j.cfg.Retention, "interval", j.cfg.Interval, "batch_size", j.cfg.BatchSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("outbox janitor stopped")
+			return
+		case <-ticker.C:
+			if _, err := j.Sweep(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("outbox janitor sweep failed", "error", err)
+			}
+		}
+	}
+}
+
+func (j *Janitor) Sweep(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		purged, err := j.store.PurgeFinished(ctx, j.cfg.Retention, j.cfg.BatchSize, j.cfg.Archiver)
+		total += purged
+		if err != nil {
+			return total, err
+		}
+		if purged < j.cfg.BatchSize {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(j.cfg.BatchPause):
+		}
+	}
+
+	if total > 0 {
+		slog.Info("outbox janitor purged finished messages", "purged", total, "retention", j.cfg.Retention)
+	}
+	return total, nil
+}
+
+func (s *SQLStore) PurgeFinished(ctx context.Context, retention time.Duration, limit int, archiver Archiver) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM outbox
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE status = 'FINISHED' AND finished_at <= datetime('now', ?)
+			ORDER BY id
+			LIMIT ?
+		)
+		RETURNING `+messageColumns,
+		fmt.Sprintf("-%d seconds", int(retention.Seconds())), limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var messages []Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if archiver != nil {
+		sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+		if err := archiver.Archive(ctx, tx, messages); err != nil {
+			return 0, fmt.Errorf("failed to archive outbox messages: %w", err)
+		}
+	}
+
+	args := make([]interface{}, len(messages))
+	for i, message := range messages {
+		args[i] = message.ID
+	}
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM outbox_attempts WHERE outbox_id IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")+") AND NOT EXISTS (SELECT 1 FROM outbox_archive WHERE outbox_archive.id = outbox_attempts.outbox_id)",
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
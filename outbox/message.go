@@ -0,0 +1,192 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	StatusPending    = "PENDING"
+	StatusProcessing = "PROCESSING"
+	StatusFinished   = "FINISHED"
+	StatusFailed     = "FAILED"
+)
+
+const (
+	AttemptDelivered = "DELIVERED"
+	AttemptRetry     = "RETRY"
+	AttemptFailed    = "FAILED"
+	AttemptRequeued  = "REQUEUED"
+)
+
+type Attempt struct {
+	OutboxID    int       `json:"outbox_id"`
+	Attempt     int       `json:"attempt"`
+	WorkerID    string    `json:"worker_id,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+type Message struct {
+	ID             int               `json:"id"`
+	MessageID      string            `json:"message_id"`
+	Status         string            `json:"status"`
+	Type           string            `json:"type"`
+	SchemaVersion  int               `json:"schema_version"`
+	CorrelationID  string            `json:"correlation_id,omitempty"`
+	CausationID    string            `json:"causation_id,omitempty"`
+	OccurredAt     time.Time         `json:"occurred_at"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Data           json.RawMessage   `json:"data"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	AggregateType  string            `json:"aggregate_type,omitempty"`
+	AggregateID    string            `json:"aggregate_id,omitempty"`
+	Stream         string            `json:"stream,omitempty"`
+	Sequence       int               `json:"sequence,omitempty"`
+	Attempts       int               `json:"attempts"`
+	LastError      string            `json:"last_error,omitempty"`
+	NextAttemptAt  time.Time         `json:"next_attempt_at"`
+	LockedBy       string            `json:"locked_by,omitempty"`
+	LockedUntil    *time.Time        `json:"locked_until,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	FinishedAt     *time.Time        `json:"finished_at,omitempty"`
+}
+
+func NewMessage(messageType string, aggregateID string, payload interface{}) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to marshal %s payload: %w", messageType, err)
+	}
+	return Message{Type: messageType, SchemaVersion: 1, AggregateID: aggregateID, Data: data}, nil
+}
+
+type Envelope struct {
+	MessageID     string            `json:"messageId"`
+	Type          string            `json:"type"`
+	SchemaVersion int               `json:"schemaVersion"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	CausationID   string            `json:"causationId,omitempty"`
+	AggregateType string            `json:"aggregateType,omitempty"`
+	AggregateID   string            `json:"aggregateId,omitempty"`
+	OccurredAt    time.Time         `json:"occurredAt"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Payload       json.RawMessage   `json:"payload"`
+}
+
+func (m Message) Envelope() Envelope {
+	return Envelope{
+		MessageID:     m.MessageID,
+		Type:          m.Type,
+		SchemaVersion: m.SchemaVersion,
+		CorrelationID: m.CorrelationID,
+		CausationID:   m.CausationID,
+		AggregateType: m.AggregateType,
+		AggregateID:   m.AggregateID,
+		OccurredAt:    m.OccurredAt,
+		Headers:       m.Headers,
+		Payload:       m.Data,
+	}
+}
+
+func Enqueue(ctx context.Context, tx *sql.Tx, message Message) (Message, error) {
+	if message.Type == "" {
+		return message, fmt.Errorf("outbox message type is required")
+	}
+	if !json.Valid(message.Data) {
+		return message, fmt.Errorf("outbox %s data is not valid json", message.Type)
+	}
+
+	if message.SchemaVersion <= 0 {
+		message.SchemaVersion = 1
+	}
+	if message.OccurredAt.IsZero() {
+		message.OccurredAt = time.Now().UTC()
+	}
+	if message.MessageID == "" {
+		messageID, err := newUUID()
+		if err != nil {
+			return message, err
+		}
+		message.MessageID = messageID
+	}
+	if message.IdempotencyKey == "" {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return message, err
+		}
+		message.IdempotencyKey = key
+	}
+
+	headers, err := json.Marshal(message.Headers)
+	if err != nil {
+		return message, fmt.Errorf("failed to marshal %s headers: %w", message.Type, err)
+	}
+	if message.Headers == nil {
+		headers = []byte("{}")
+	}
+
+	var aggregateID, stream, sequence interface{}
+	if message.AggregateID != "" {
+		if message.Stream == "" {
+			message.Stream = message.AggregateID
+		}
+		err := tx.QueryRowContext(ctx,
+			"INSERT INTO outbox_sequences (stream, sequence) VALUES (?, 1) ON CONFLICT (stream) DO UPDATE SET sequence = sequence + 1 RETURNING sequence",
+			message.Stream,
+		).Scan(&message.Sequence)
+		if err != nil {
+			return message, err
+		}
+		aggregateID, stream, sequence = message.AggregateID, message.Stream, message.Sequence
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO outbox (message_id, status, type, schema_version, correlation_id, causation_id, occurred_at, headers, data, idempotency_key, aggregate_type, aggregate_id, stream, sequence) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		message.MessageID, StatusPending, message.Type, message.SchemaVersion, nullString(message.CorrelationID), nullString(message.CausationID), message.OccurredAt, string(headers), string(message.Data), message.IdempotencyKey, nullString(message.AggregateType), aggregateID, stream, sequence,
+	)
+	if err != nil {
+		return message, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return message, err
+	}
+	message.ID = int(id)
+	message.Status = StatusPending
+
+	slog.Info("outbox message inserted", "id", message.ID, "message_id", message.MessageID, "type", message.Type, "schema_version", message.SchemaVersion, "correlation_id", message.CorrelationID, "aggregate_type", message.AggregateType, "aggregate_id", message.AggregateID, "stream", message.Stream, "sequence", message.Sequence, "data", string(message.Data))
+	return message, nil
+}
+
+func newIdempotencyKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func newUUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16]), nil
+}
+
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_outbox_aggregate_sequence;
+DROP TABLE IF EXISTS outbox;
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS outbox_changes_after_requeue;
+DROP TRIGGER IF EXISTS outbox_changes_after_insert;
+DROP TABLE IF EXISTS outbox_cdc_offsets;
+DROP TABLE IF EXISTS outbox_changes;
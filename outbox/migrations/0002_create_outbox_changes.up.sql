@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS outbox_changes (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	outbox_id INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS outbox_cdc_offsets (
+	consumer TEXT PRIMARY KEY,
+	last_seq INTEGER NOT NULL DEFAULT 0,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS outbox_changes_after_insert
+AFTER INSERT ON outbox
+WHEN EXISTS (SELECT 1 FROM outbox_cdc_offsets)
+BEGIN
+	INSERT INTO outbox_changes (outbox_id, operation) VALUES (NEW.id, 'INSERT');
+END;
+
+CREATE TRIGGER IF NOT EXISTS outbox_changes_after_requeue
+AFTER UPDATE OF status ON outbox
+WHEN OLD.status = 'FAILED' AND NEW.status = 'PENDING' AND EXISTS (SELECT 1 FROM outbox_cdc_offsets)
+BEGIN
+	INSERT INTO outbox_changes (outbox_id, operation) VALUES (NEW.id, 'REQUEUE');
+END;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_outbox_message_id;
+
+ALTER TABLE outbox DROP COLUMN headers;
+ALTER TABLE outbox DROP COLUMN occurred_at;
+ALTER TABLE outbox DROP COLUMN causation_id;
+ALTER TABLE outbox DROP COLUMN correlation_id;
+ALTER TABLE outbox DROP COLUMN schema_version;
+ALTER TABLE outbox DROP COLUMN message_id;
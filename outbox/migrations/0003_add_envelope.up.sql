@@ -0,0 +1,11 @@
+ALTER TABLE outbox ADD COLUMN message_id TEXT;
+ALTER TABLE outbox ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE outbox ADD COLUMN correlation_id TEXT;
+ALTER TABLE outbox ADD COLUMN causation_id TEXT;
+ALTER TABLE outbox ADD COLUMN occurred_at DATETIME;
+ALTER TABLE outbox ADD COLUMN headers TEXT NOT NULL DEFAULT '{}';
+
+UPDATE outbox SET message_id = lower(hex(randomblob(16))) WHERE message_id IS NULL;
+UPDATE outbox SET occurred_at = created_at WHERE occurred_at IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_outbox_message_id ON outbox (message_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_outbox_status_next_attempt;
+DROP INDEX IF EXISTS idx_outbox_archive_aggregate_sequence;
+DROP TABLE IF EXISTS outbox_archive;
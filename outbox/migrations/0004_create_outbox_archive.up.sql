@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS outbox_archive (
+	id INTEGER PRIMARY KEY,
+	message_id TEXT,
+	status TEXT NOT NULL,
+	type TEXT NOT NULL,
+	schema_version INTEGER NOT NULL DEFAULT 1,
+	correlation_id TEXT,
+	causation_id TEXT,
+	occurred_at DATETIME,
+	headers TEXT NOT NULL DEFAULT '{}',
+	data TEXT NOT NULL,
+	idempotency_key TEXT,
+	aggregate_id TEXT,
+	sequence INTEGER,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at DATETIME NOT NULL,
+	locked_by TEXT,
+	locked_until DATETIME,
+	created_at DATETIME NOT NULL,
+	finished_at DATETIME,
+	archived_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_archive_aggregate_sequence ON outbox_archive (aggregate_id, sequence);
+CREATE INDEX IF NOT EXISTS idx_outbox_status_next_attempt ON outbox (status, next_attempt_at);
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS outbox_attempts_after_fail;
+DROP TRIGGER IF EXISTS outbox_attempts_after_retry;
+DROP TRIGGER IF EXISTS outbox_attempts_after_finish;
+DROP INDEX IF EXISTS idx_outbox_attempts_outbox_id;
+DROP TABLE IF EXISTS outbox_attempts;
+
+ALTER TABLE outbox_archive DROP COLUMN aggregate_type;
+ALTER TABLE outbox DROP COLUMN aggregate_type;
@@ -0,0 +1,35 @@
+ALTER TABLE outbox ADD COLUMN aggregate_type TEXT;
+ALTER TABLE outbox_archive ADD COLUMN aggregate_type TEXT;
+
+CREATE TABLE IF NOT EXISTS outbox_attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	outbox_id INTEGER NOT NULL,
+	attempt INTEGER NOT NULL,
+	worker_id TEXT,
+	outcome TEXT NOT NULL,
+	error TEXT,
+	attempted_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_attempts_outbox_id ON outbox_attempts (outbox_id);
+
+CREATE TRIGGER IF NOT EXISTS outbox_attempts_after_finish
+AFTER UPDATE OF status ON outbox
+WHEN OLD.status = 'PROCESSING' AND NEW.status = 'FINISHED'
+BEGIN
+	INSERT INTO outbox_attempts (outbox_id, attempt, worker_id, outcome) VALUES (NEW.id, OLD.attempts + 1, OLD.locked_by, 'DELIVERED');
+END;
+
+CREATE TRIGGER IF NOT EXISTS outbox_attempts_after_retry
+AFTER UPDATE OF status ON outbox
+WHEN OLD.status = 'PROCESSING' AND NEW.status = 'PENDING' AND NEW.attempts > OLD.attempts
+BEGIN
+	INSERT INTO outbox_attempts (outbox_id, attempt, worker_id, outcome, error) VALUES (NEW.id, NEW.attempts, OLD.locked_by, 'RETRY', NEW.last_error);
+END;
+
+CREATE TRIGGER IF NOT EXISTS outbox_attempts_after_fail
+AFTER UPDATE OF status ON outbox
+WHEN OLD.status = 'PROCESSING' AND NEW.status = 'FAILED'
+BEGIN
+	INSERT INTO outbox_attempts (outbox_id, attempt, worker_id, outcome, error) VALUES (NEW.id, NEW.attempts, OLD.locked_by, 'FAILED', NEW.last_error);
+END;
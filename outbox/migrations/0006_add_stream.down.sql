@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_outbox_stream_sequence;
+
+ALTER TABLE outbox_archive DROP COLUMN stream;
+ALTER TABLE outbox DROP COLUMN stream;
@@ -0,0 +1,7 @@
+ALTER TABLE outbox ADD COLUMN stream TEXT;
+ALTER TABLE outbox_archive ADD COLUMN stream TEXT;
+
+UPDATE outbox SET stream = aggregate_id WHERE stream IS NULL;
+UPDATE outbox_archive SET stream = aggregate_id WHERE stream IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_outbox_stream_sequence ON outbox (stream, sequence);
@@ -0,0 +1 @@
+DROP TRIGGER IF EXISTS outbox_attempts_after_requeue;
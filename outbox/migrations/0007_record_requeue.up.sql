@@ -0,0 +1,6 @@
+CREATE TRIGGER IF NOT EXISTS outbox_attempts_after_requeue
+AFTER UPDATE OF status ON outbox
+WHEN OLD.status = 'FAILED' AND NEW.status = 'PENDING'
+BEGIN
+	INSERT INTO outbox_attempts (outbox_id, attempt, outcome, error) VALUES (NEW.id, NEW.attempts, 'REQUEUED', OLD.last_error);
+END;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbox_sequences (
+	stream TEXT PRIMARY KEY,
+	sequence INTEGER NOT NULL
+);
+
+INSERT INTO outbox_sequences (stream, sequence)
+SELECT stream, MAX(sequence) FROM (
+	SELECT stream, sequence FROM outbox WHERE stream IS NOT NULL AND sequence IS NOT NULL
+	UNION ALL
+	SELECT stream, sequence FROM outbox_archive WHERE stream IS NOT NULL AND sequence IS NOT NULL
+)
+GROUP BY stream;
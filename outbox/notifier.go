@@ -0,0 +1,49 @@
+package outbox
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type Notifier interface {
+	Notify()
+}
+
+type NopNotifier struct{}
+
+func (NopNotifier) Notify() {}
+
+type HTTPNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPNotifier(url string) *HTTPNotifier {
+	return &HTTPNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 500 * time.Millisecond},
+	}
+}
+
+func (n *HTTPNotifier) Notify() {
+	go func() {
+		resp, err := n.client.Post(n.url, "application/json", nil)
+		if err != nil {
+			slog.Debug("outbox relay wakeup failed, relay will pick messages up on its next poll", "url", n.url, "error", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+func WakeupHandler(notifier Notifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		notifier.Notify()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
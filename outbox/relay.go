@@ -0,0 +1,354 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ModePoll = "poll"
+	ModeCDC  = "cdc"
+)
+
+type RelayConfig struct {
+	Mode            string
+	PollInterval    time.Duration
+	CDCInterval     time.Duration
+	CDCConsumer     string
+	BatchSize       int
+	LeaseDuration   time.Duration
+	WorkerID        string
+	MaxAttempts     int
+	Backoff         BackoffPolicy
+	TypeBackoff     map[string]BackoffPolicy
+	Concurrency     int
+	TypeConcurrency map[string]int
+	Registry        *Registry
+	Validator       Validator
+}
+
+type Relay struct {
+	store       Store
+	cfg         RelayConfig
+	mu          sync.Mutex
+	running     int
+	typeRunning map[string]int
+	deliveries  sync.WaitGroup
+	wakeup      chan struct{}
+}
+
+func NewRelay(store Store, cfg RelayConfig) *Relay {
+	if cfg.Mode == "" {
+		cfg.Mode = ModePoll
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 10 * time.Second
+	}
+	if cfg.CDCInterval <= 0 {
+		cfg.CDCInterval = 200 * time.Millisecond
+	}
+	if cfg.CDCConsumer == "" {
+		cfg.CDCConsumer = "outbox-relay"
+	}
+	if cfg.WorkerID == "" {
+		cfg.WorkerID = defaultWorkerID()
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = 60 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.Backoff.Base <= 0 {
+		cfg.Backoff = DefaultBackoffPolicy()
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 10
+	}
+	if cfg.Registry == nil {
+		cfg.Registry = DefaultRegistry
+	}
+
+	return &Relay{
+		store:       store,
+		cfg:         cfg,
+		typeRunning: make(map[string]int),
+		wakeup:      make(chan struct{}, 1),
+	}
+}
+
+func defaultWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "outbox-relay"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func (r *Relay) Config() RelayConfig {
+	return r.cfg
+}
+
+func (r *Relay) Run(ctx context.Context) error {
+	switch r.cfg.Mode {
+	case ModePoll:
+		return r.runPoll(ctx)
+	case ModeCDC:
+		return r.runCDC(ctx)
+	default:
+		return fmt.Errorf("unknown relay mode: %s", r.cfg.Mode)
+	}
+}
+
+func (r *Relay) runPoll(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	slog.Info("outbox relay started", "mode", r.cfg.Mode, "poll_interval", r.cfg.PollInterval, "worker_id", r.cfg.WorkerID, "batch_size", r.cfg.BatchSize, "lease", r.cfg.LeaseDuration, "max_attempts", r.cfg.MaxAttempts, "concurrency", r.cfg.Concurrency, "handlers", r.cfg.Registry.Types())
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("outbox relay draining in-flight deliveries", "in_flight", r.inFlight())
+			r.Wait()
+			slog.Info("outbox relay stopped")
+			return nil
+		case <-ticker.C:
+			r.Poll(ctx)
+		case <-r.wakeup:
+			r.Poll(ctx)
+		}
+	}
+}
+
+func (r *Relay) runCDC(ctx context.Context) error {
+	changeLog, ok := r.store.(ChangeLog)
+	if !ok {
+		return fmt.Errorf("store does not support %s mode", ModeCDC)
+	}
+
+	offset, err := changeLog.Subscribe(ctx, r.cfg.CDCConsumer)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to outbox change log: %w", err)
+	}
+
+	tail := time.NewTicker(r.cfg.CDCInterval)
+	defer tail.Stop()
+	fallback := time.NewTicker(r.cfg.PollInterval)
+	defer fallback.Stop()
+
+	slog.Info("outbox relay started", "mode", r.cfg.Mode, "consumer", r.cfg.CDCConsumer, "offset", offset, "cdc_interval", r.cfg.CDCInterval, "poll_interval", r.cfg.PollInterval, "worker_id", r.cfg.WorkerID, "concurrency", r.cfg.Concurrency, "handlers", r.cfg.Registry.Types())
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("outbox relay draining in-flight deliveries", "in_flight", r.inFlight())
+			r.Wait()
+			slog.Info("outbox relay stopped")
+			return nil
+		case <-tail.C:
+			offset = r.tail(ctx, changeLog, offset)
+		case <-r.wakeup:
+			offset = r.tail(ctx, changeLog, offset)
+			r.Poll(ctx)
+		case <-fallback.C:
+			r.Poll(ctx)
+		}
+	}
+}
+
+func (r *Relay) tail(ctx context.Context, changeLog ChangeLog, offset int64) int64 {
+	capacity, typeCapacity := r.capacity()
+	if capacity == 0 {
+		return offset
+	}
+
+	changes, err := changeLog.ChangesSince(ctx, offset, capacity)
+	if err != nil {
+		slog.Error("failed to read outbox change log", "offset", offset, "error", err)
+		return offset
+	}
+	if len(changes) == 0 {
+		return offset
+	}
+
+	ids := make([]int, 0, len(changes))
+	for _, change := range changes {
+		ids = append(ids, change.OutboxID)
+	}
+
+	messages, err := changeLog.ClaimIDs(ctx, r.cfg.WorkerID, ids, typeCapacity, r.cfg.LeaseDuration)
+	if err != nil {
+		slog.Error("failed to claim streamed outbox messages", "error", err)
+		return offset
+	}
+
+	for _, message := range messages {
+		r.dispatch(ctx, message)
+	}
+
+	last := changes[len(changes)-1].Seq
+	if err := changeLog.Commit(ctx, r.cfg.CDCConsumer, last); err != nil {
+		slog.Error("failed to commit outbox change log offset", "offset", last, "error", err)
+	}
+
+	slog.Info("streamed outbox changes", "changes", len(changes), "claimed", len(messages), "offset", last)
+	return last
+}
+
+func (r *Relay) Notify() {
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) Poll(ctx context.Context) {
+	capacity, typeCapacity := r.capacity()
+	slog.Info("processing outbox messages", "worker_id", r.cfg.WorkerID, "in_flight", r.inFlight(), "capacity", capacity, "type_capacity", typeCapacity)
+
+	if capacity == 0 {
+		slog.Info("dispatch pool is full, skipping claim")
+		return
+	}
+
+	messages, err := r.store.Claim(ctx, r.cfg.WorkerID, capacity, typeCapacity, r.cfg.LeaseDuration)
+	if err != nil {
+		slog.Error("failed to claim outbox messages", "error", err)
+		return
+	}
+	slog.Info("claimed outbox messages", "count", len(messages))
+
+	if len(messages) == 0 {
+		slog.Info("no pending messages to process")
+		return
+	}
+
+	for _, message := range messages {
+		r.dispatch(ctx, message)
+	}
+}
+
+func (r *Relay) Wait() {
+	r.deliveries.Wait()
+}
+
+func (r *Relay) capacity() (int, map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	free := r.cfg.Concurrency - r.running
+	if free > r.cfg.BatchSize {
+		free = r.cfg.BatchSize
+	}
+	if free < 0 {
+		free = 0
+	}
+
+	typeFree := make(map[string]int, len(r.cfg.TypeConcurrency))
+	for messageType, limit := range r.cfg.TypeConcurrency {
+		if limit <= 0 {
+			continue
+		}
+		available := limit - r.typeRunning[messageType]
+		if available > free {
+			available = free
+		}
+		if available < 0 {
+			available = 0
+		}
+		typeFree[messageType] = available
+	}
+	return free, typeFree
+}
+
+func (r *Relay) inFlight() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.running
+}
+
+func (r *Relay) dispatch(ctx context.Context, message Message) {
+	deadline := time.Now().Add(r.cfg.LeaseDuration / 2)
+
+	r.mu.Lock()
+	r.running++
+	r.typeRunning[message.Type]++
+	r.mu.Unlock()
+
+	r.deliveries.Add(1)
+	go func() {
+		defer r.deliveries.Done()
+		defer func() {
+			r.mu.Lock()
+			r.running--
+			r.typeRunning[message.Type]--
+			r.mu.Unlock()
+		}()
+
+		r.deliver(context.WithoutCancel(ctx), message, deadline)
+	}()
+}
+
+func (r *Relay) deliver(ctx context.Context, message Message, deadline time.Time) {
+	slog.Info("processing outbox message", "id", message.ID, "type", message.Type, "aggregate_id", message.AggregateID, "stream", message.Stream, "sequence", message.Sequence, "data", string(message.Data))
+
+	if r.cfg.Validator != nil {
+		if err := r.cfg.Validator.Validate(message.Type, message.SchemaVersion, message.Data); err != nil {
+			slog.Error("outbox message failed schema validation", "id", message.ID, "type", message.Type, "schema_version", message.SchemaVersion, "error", err)
+			r.fail(ctx, message, Permanent(err))
+			return
+		}
+	}
+
+	handler, ok := r.cfg.Registry.Lookup(message.Type)
+	if !ok {
+		r.fail(ctx, message, Permanent(fmt.Errorf("unknown message type: %s", message.Type)))
+		return
+	}
+
+	handleCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if err := handler.Handle(handleCtx, message); err != nil {
+		slog.Error("failed to process outbox message", "id", message.ID, "type", message.Type, "error", err)
+		r.fail(ctx, message, err)
+		return
+	}
+
+	if err := r.store.Finish(ctx, r.cfg.WorkerID, message); err != nil {
+		slog.Error("failed to update outbox message status", "id", message.ID, "error", err)
+		return
+	}
+	slog.Info("outbox message processed successfully", "id", message.ID, "type", message.Type)
+
+	if message.AggregateID != "" {
+		r.Notify()
+	}
+}
+
+func (r *Relay) fail(ctx context.Context, message Message, cause error) {
+	attempts := message.Attempts + 1
+	if IsPermanent(cause) || attempts >= r.cfg.MaxAttempts {
+		if err := r.store.Fail(ctx, r.cfg.WorkerID, message, attempts, cause); err != nil {
+			slog.Error("failed to mark outbox message as failed", "id", message.ID, "error", err)
+			return
+		}
+		slog.Error("outbox message moved to FAILED", "id", message.ID, "type", message.Type, "attempts", attempts, "permanent", IsPermanent(cause), "error", cause)
+		return
+	}
+
+	delay := r.cfg.backoffFor(message.Type).Delay(attempts)
+	if err := r.store.Retry(ctx, r.cfg.WorkerID, message, attempts, delay, cause); err != nil {
+		slog.Error("failed to release outbox message", "id", message.ID, "error", err)
+		return
+	}
+	slog.Info("outbox message scheduled for retry", "id", message.ID, "type", message.Type, "attempts", attempts, "backoff", delay.Round(time.Millisecond))
+}
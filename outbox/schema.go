@@ -0,0 +1,20 @@
+package outbox
+
+import (
+	"embed"
+
+	"substack-outbox/migration"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func Migrations(service string, databasePath string) migration.Source {
+	return migration.Source{
+		Name:  service + "/outbox",
+		Path:  databasePath,
+		FS:    migrationFiles,
+		Dir:   "migrations",
+		Table: "outbox_schema_migrations",
+	}
+}
@@ -0,0 +1,343 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"substack-outbox/listing"
+)
+
+type Store interface {
+	Claim(ctx context.Context, workerID string, limit int, typeLimits map[string]int, lease time.Duration) ([]Message, error)
+	Finish(ctx context.Context, workerID string, message Message) error
+	Retry(ctx context.Context, workerID string, message Message, attempts int, delay time.Duration, cause error) error
+	Fail(ctx context.Context, workerID string, message Message, attempts int, cause error) error
+	Release(ctx context.Context, workerID string, message Message) error
+}
+
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+const messageColumns = "id, message_id, status, type, schema_version, correlation_id, causation_id, occurred_at, headers, data, idempotency_key, aggregate_type, aggregate_id, stream, sequence, attempts, last_error, next_attempt_at, locked_by, locked_until, created_at, finished_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner, extra ...interface{}) (Message, error) {
+	var message Message
+	var data, headers string
+	var messageID, correlationID, causationID, idempotencyKey, aggregateType, aggregateID, stream, lastError, lockedBy sql.NullString
+	var sequence sql.NullInt64
+	var occurredAt, lockedUntil, finishedAt sql.NullTime
+	dest := []interface{}{&message.ID, &messageID, &message.Status, &message.Type, &message.SchemaVersion, &correlationID, &causationID, &occurredAt, &headers, &data, &idempotencyKey, &aggregateType, &aggregateID, &stream, &sequence, &message.Attempts, &lastError, &message.NextAttemptAt, &lockedBy, &lockedUntil, &message.CreatedAt, &finishedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return message, err
+	}
+
+	message.Data = []byte(data)
+	if err := json.Unmarshal([]byte(headers), &message.Headers); err != nil {
+		return message, fmt.Errorf("invalid headers on outbox message %d: %w", message.ID, err)
+	}
+	message.MessageID = messageID.String
+	message.CorrelationID = correlationID.String
+	message.CausationID = causationID.String
+	message.OccurredAt = message.CreatedAt
+	if occurredAt.Valid {
+		message.OccurredAt = occurredAt.Time
+	}
+	message.IdempotencyKey = idempotencyKey.String
+	if message.IdempotencyKey == "" {
+		message.IdempotencyKey = fmt.Sprintf("outbox-%d", message.ID)
+	}
+	message.AggregateType = aggregateType.String
+	message.AggregateID = aggregateID.String
+	message.Stream = stream.String
+	message.Sequence = int(sequence.Int64)
+	message.LastError = lastError.String
+	message.LockedBy = lockedBy.String
+	if lockedUntil.Valid {
+		message.LockedUntil = &lockedUntil.Time
+	}
+	if finishedAt.Valid {
+		message.FinishedAt = &finishedAt.Time
+	}
+	return message, nil
+}
+
+func (s *SQLStore) Claim(ctx context.Context, workerID string, limit int, typeLimits map[string]int, lease time.Duration) ([]Message, error) {
+	return s.claim(ctx, workerID, lease, nil, limit, typeLimits)
+}
+
+func (s *SQLStore) claim(ctx context.Context, workerID string, lease time.Duration, ids []int, limit int, typeLimits map[string]int) ([]Message, error) {
+	args := []interface{}{workerID, SecondsModifier(lease)}
+
+	idFilter := ""
+	if len(ids) > 0 {
+		idFilter = "AND candidate.id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	typeFilter := ""
+	if len(typeLimits) > 0 {
+		types := make([]string, 0, len(typeLimits))
+		for messageType := range typeLimits {
+			types = append(types, messageType)
+		}
+		sort.Strings(types)
+
+		typeFilter = "WHERE type_rank <= CASE type"
+		for _, messageType := range types {
+			typeFilter += " WHEN ? THEN ?"
+			args = append(args, messageType, typeLimits[messageType])
+		}
+		typeFilter += " ELSE type_rank END"
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE outbox
+		SET status = 'PROCESSING', locked_by = ?, locked_until = datetime('now', ?)
+		WHERE id IN (
+			SELECT id FROM (
+				SELECT candidate.id, candidate.type, ROW_NUMBER() OVER (PARTITION BY candidate.type ORDER BY candidate.id) AS type_rank
+				FROM outbox candidate
+				WHERE (
+					(candidate.status = 'PENDING' AND candidate.next_attempt_at <= CURRENT_TIMESTAMP)
+					OR (candidate.status = 'PROCESSING' AND candidate.locked_until < CURRENT_TIMESTAMP)
+				)
+				AND NOT EXISTS (
+					SELECT 1 FROM outbox earlier
+					WHERE earlier.stream = candidate.stream
+						AND earlier.sequence < candidate.sequence
+						AND earlier.status != 'FINISHED'
+				)
+				`+idFilter+`
+			)
+			`+typeFilter+`
+			ORDER BY id
+			LIMIT ?
+		)
+		RETURNING `+messageColumns,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (s *SQLStore) Finish(ctx context.Context, workerID string, message Message) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE outbox SET status = 'FINISHED', finished_at = CURRENT_TIMESTAMP, last_error = NULL, locked_by = NULL, locked_until = NULL WHERE id = ? AND locked_by = ?",
+		message.ID, workerID,
+	)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(result, message)
+}
+
+func (s *SQLStore) Retry(ctx context.Context, workerID string, message Message, attempts int, delay time.Duration, cause error) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET status = 'PENDING', attempts = ?, last_error = ?, next_attempt_at = datetime('now', ?), locked_by = NULL, locked_until = NULL
+		WHERE id = ? AND locked_by = ?`,
+		attempts, cause.Error(), SecondsModifier(delay), message.ID, workerID,
+	)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(result, message)
+}
+
+func (s *SQLStore) Fail(ctx context.Context, workerID string, message Message, attempts int, cause error) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE outbox SET status = 'FAILED', attempts = ?, last_error = ?, locked_by = NULL, locked_until = NULL WHERE id = ? AND locked_by = ?",
+		attempts, cause.Error(), message.ID, workerID,
+	)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(result, message)
+}
+
+func (s *SQLStore) Release(ctx context.Context, workerID string, message Message) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE outbox SET status = 'PENDING', locked_by = NULL, locked_until = NULL WHERE id = ? AND locked_by = ?",
+		message.ID, workerID,
+	)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(result, message)
+}
+
+func leaseHeld(result sql.Result, message Message) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: %d", ErrLeaseLost, message.ID)
+	}
+	return nil
+}
+
+func (s *SQLStore) List(ctx context.Context, query listing.Query) ([]Message, string, error) {
+	statement, args := query.SQL("outbox", messageColumns)
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	page := query.Page()
+	for rows.Next() {
+		var key string
+		message, err := scanMessage(rows, &key)
+		if err != nil {
+			return nil, "", err
+		}
+		if !page.Add(key, message.ID) {
+			break
+		}
+		messages = append(messages, message)
+	}
+	return messages, page.Next(), rows.Err()
+}
+
+func (s *SQLStore) Get(ctx context.Context, id int) (Message, error) {
+	message, err := scanMessage(s.db.QueryRowContext(ctx,
+		"SELECT "+messageColumns+" FROM outbox WHERE id = ? UNION ALL SELECT "+messageColumns+" FROM outbox_archive WHERE id = ? LIMIT 1",
+		id, id,
+	))
+	if err == sql.ErrNoRows {
+		return message, ErrNotFound
+	}
+	return message, err
+}
+
+func (s *SQLStore) ListByAggregate(ctx context.Context, aggregateID string) ([]Message, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+messageColumns+" FROM outbox WHERE aggregate_id = ? UNION ALL SELECT "+messageColumns+" FROM outbox_archive WHERE aggregate_id = ? ORDER BY sequence, id",
+		aggregateID, aggregateID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (s *SQLStore) AttemptsByAggregate(ctx context.Context, aggregateID string) ([]Attempt, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT outbox_id, attempt, worker_id, outcome, error, attempted_at FROM outbox_attempts
+		WHERE outbox_id IN (
+			SELECT id FROM outbox WHERE aggregate_id = ?
+			UNION SELECT id FROM outbox_archive WHERE aggregate_id = ?
+		)
+		ORDER BY id`,
+		aggregateID, aggregateID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []Attempt{}
+	for rows.Next() {
+		var attempt Attempt
+		var workerID, cause sql.NullString
+		if err := rows.Scan(&attempt.OutboxID, &attempt.Attempt, &workerID, &attempt.Outcome, &cause, &attempt.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempt.WorkerID = workerID.String
+		attempt.Error = cause.String
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+const requeueQuery = `
+	UPDATE outbox
+	SET status = 'PENDING', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, locked_by = NULL, locked_until = NULL
+	WHERE status = 'FAILED'`
+
+func (s *SQLStore) Requeue(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx, requeueQuery+" AND id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+
+	var status string
+	err = s.db.QueryRowContext(ctx, "SELECT status FROM outbox WHERE id = ?", id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: message is %s, only FAILED messages can be retried", ErrNotRequeueable, status)
+}
+
+func (s *SQLStore) RequeueFailed(ctx context.Context, messageType string) (int64, error) {
+	query := requeueQuery
+	var args []interface{}
+	if messageType != "" {
+		query += " AND type = ?"
+		args = append(args, messageType)
+	}
+
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func SecondsModifier(d time.Duration) string {
+	return fmt.Sprintf("+%d seconds", int(math.Ceil(d.Seconds())))
+}
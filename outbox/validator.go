@@ -0,0 +1,11 @@
+package outbox
+
+type Validator interface {
+	Validate(messageType string, schemaVersion int, data []byte) error
+}
+
+type ValidatorFunc func(messageType string, schemaVersion int, data []byte) error
+
+func (f ValidatorFunc) Validate(messageType string, schemaVersion int, data []byte) error {
+	return f(messageType, schemaVersion, data)
+}
@@ -0,0 +1,257 @@
+package smtpsink
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hostname        = "smtp-sink"
+	commandTimeout  = 5 * time.Minute
+	maxMessageBytes = 25 << 20
+)
+
+type Config struct {
+	Addr string
+	Dir  string
+}
+
+var messageSequence int64
+
+func Run(ctx context.Context, config Config) error {
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create sink directory: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", config.Addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	slog.Info("smtp sink started", "addr", config.Addr, "dir", config.Dir)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.Error("failed to accept smtp connection", "error", err)
+			continue
+		}
+		go serve(conn, config.Dir)
+	}
+}
+
+type session struct {
+	conn net.Conn
+	text *textproto.Conn
+	dir  string
+	user string
+	from string
+	to   []string
+}
+
+func serve(conn net.Conn, dir string) {
+	s := &session{conn: conn, text: textproto.NewConn(conn), dir: dir}
+	defer s.text.Close()
+
+	remote := conn.RemoteAddr().String()
+	if err := s.reply(220, hostname+" ESMTP ready"); err != nil {
+		return
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				slog.Error("smtp connection failed", "remote", remote, "error", err)
+			}
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			err = s.text.PrintfLine("250-%s\r\n250-8BITMIME\r\n250-SIZE %d\r\n250-AUTH PLAIN LOGIN\r\n250 HELP", hostname, maxMessageBytes)
+		case "HELO":
+			err = s.reply(250, hostname)
+		case "AUTH":
+			err = s.auth(arg)
+		case "MAIL":
+			err = s.mail(arg)
+		case "RCPT":
+			err = s.rcpt(arg)
+		case "DATA":
+			err = s.data(remote)
+		case "RSET":
+			s.reset()
+			err = s.reply(250, "OK")
+		case "NOOP":
+			err = s.reply(250, "OK")
+		case "STARTTLS":
+			err = s.reply(454, "TLS not available")
+		case "QUIT":
+			s.reply(221, "Bye")
+			return
+		default:
+			err = s.reply(502, "Command not implemented")
+		}
+		if err != nil {
+			slog.Error("smtp connection failed", "remote", remote, "error", err)
+			return
+		}
+	}
+}
+
+func (s *session) reply(code int, message string) error {
+	return s.text.PrintfLine("%d %s", code, message)
+}
+
+func (s *session) reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) auth(arg string) error {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			response, err := s.challenge("")
+			if err != nil {
+				return err
+			}
+			initial = response
+		}
+		credentials, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return s.reply(501, "Invalid credentials encoding")
+		}
+		if parts := strings.Split(string(credentials), "\x00"); len(parts) == 3 {
+			s.user = parts[1]
+		}
+	case "LOGIN":
+		username, err := s.challenge("Username:")
+		if err != nil {
+			return err
+		}
+		if _, err := s.challenge("Password:"); err != nil {
+			return err
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(username)
+		s.user = string(decoded)
+	default:
+		return s.reply(504, "Unrecognized authentication mechanism")
+	}
+	return s.reply(235, "Authentication successful")
+}
+
+func (s *session) challenge(prompt string) (string, error) {
+	if err := s.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+		return "", err
+	}
+	return s.text.ReadLine()
+}
+
+func (s *session) mail(arg string) error {
+	address, ok := pathArgument(arg, "FROM:")
+	if !ok {
+		return s.reply(501, "Syntax: MAIL FROM:<address>")
+	}
+	s.reset()
+	s.from = address
+	return s.reply(250, "OK")
+}
+
+func (s *session) rcpt(arg string) error {
+	if s.from == "" {
+		return s.reply(503, "MAIL FROM required first")
+	}
+	address, ok := pathArgument(arg, "TO:")
+	if !ok || address == "" {
+		return s.reply(501, "Syntax: RCPT TO:<address>")
+	}
+	s.to = append(s.to, address)
+	return s.reply(250, "OK")
+}
+
+func (s *session) data(remote string) error {
+	if len(s.to) == 0 {
+		return s.reply(503, "RCPT TO required first")
+	}
+	if err := s.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+
+	reader := s.text.DotReader()
+	message, err := io.ReadAll(io.LimitReader(reader, maxMessageBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(message) > maxMessageBytes {
+		io.Copy(io.Discard, reader)
+		s.reset()
+		return s.reply(552, "Message exceeds maximum size")
+	}
+
+	path, err := s.capture(message)
+	s.reset()
+	if err != nil {
+		slog.Error("failed to capture message", "remote", remote, "error", err)
+		return s.reply(451, "Failed to store message")
+	}
+	return s.reply(250, "OK queued as "+filepath.Base(path))
+}
+
+func (s *session) capture(message []byte) (string, error) {
+	name := fmt.Sprintf("%d-%04d.eml", time.Now().UnixNano(), atomic.AddInt64(&messageSequence, 1))
+	path := filepath.Join(s.dir, name)
+
+	envelope := fmt.Sprintf("X-Sink-Mail-From: <%s>\nX-Sink-Rcpt-To: %s\nX-Sink-Received-At: %s\n",
+		s.from, "<"+strings.Join(s.to, ">, <")+">", time.Now().UTC().Format(time.RFC3339Nano))
+	if s.user != "" {
+		envelope += "X-Sink-Auth-User: " + s.user + "\n"
+	}
+
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, append([]byte(envelope), message...), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		os.Remove(temporary)
+		return "", err
+	}
+
+	slog.Info("message captured", "from", s.from, "to", s.to, "bytes", len(message), "path", path)
+	return path, nil
+}
+
+func pathArgument(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if parameters := strings.Index(path, " "); parameters >= 0 {
+		path = path[:parameters]
+	}
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
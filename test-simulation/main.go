@@ -4,14 +4,49 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	basicOrderURL     = "http://localhost:8080/finish-order"
+	improvedOrderURL  = "http://localhost:8083/finish-order-improved"
+	basicOrdersURL    = "http://localhost:8080/orders"
+	improvedOrdersURL = "http://localhost:8083/orders"
+	emailsURL         = "http://localhost:8081/emails"
+	notificationsURL  = "http://localhost:8082/notifications"
+	improvedOutboxURL = "http://localhost:8083/outbox"
+	sagaOrderURL      = "http://localhost:8084/finish-order-saga"
+	sagasURL          = "http://localhost:8084/sagas"
+
+	emailServiceURL        = "http://localhost:8081"
+	notificationServiceURL = "http://localhost:8082"
+)
+
+var (
+	cancellationOrderID = regexp.MustCompile(`ORDER-CANCEL-(BASIC|IMPROVED)-[0-9]+-[0-9]{4}`)
+	sagaOrderID         = regexp.MustCompile(`ORDER-SAGA-[0-9]+-[0-9]{4}`)
+)
+
+type customerMessages struct {
+	completionEmails  int
+	apologyEmails     int
+	completionNotices int
+	retractions       int
+}
+
 type OrderRequest struct {
 	OrderID   string `json:"orderId"`
 	UserName  string `json:"userName"`
@@ -21,7 +56,7 @@ type OrderRequest struct {
 
 func main() {
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: go run test-simulation/main.go <basic|improved> <order_count>")
+		fmt.Println("Usage: go run test-simulation/main.go <basic|improved|saga|duplicates|cancellations|smtp> <count>")
 		os.Exit(1)
 	}
 
@@ -41,8 +76,24 @@ func main() {
 		runBasicSimulation(orderCount)
 	case "improved":
 		runImprovedSimulation(orderCount)
+	case "saga":
+		if !runSagaSimulation(orderCount) {
+			os.Exit(1)
+		}
+	case "duplicates":
+		if !runDuplicateSimulation(orderCount) {
+			os.Exit(1)
+		}
+	case "cancellations":
+		if !runCancellationSimulation(orderCount) {
+			os.Exit(1)
+		}
+	case "smtp":
+		if !runSMTPSimulation(orderCount) {
+			os.Exit(1)
+		}
 	default:
-		fmt.Printf("Unknown mode: %s. Use 'basic' or 'improved'\n", mode)
+		fmt.Printf("Unknown mode: %s. Use 'basic', 'improved', 'saga', 'duplicates', 'cancellations' or 'smtp'\n", mode)
 		os.Exit(1)
 	}
 }
@@ -113,32 +164,727 @@ func runImprovedSimulation(orderCount int) {
 	fmt.Printf("Improved simulation completed. Success: %d, Failures: %d\n", successCount, failureCount)
 }
 
-func sendBasicOrder(req OrderRequest) error {
-	jsonData, _ := json.Marshal(req)
-	resp, err := http.Post("http://localhost:8080/finish-order", "application/json", bytes.NewBuffer(jsonData))
+func runSagaSimulation(orderCount int) bool {
+	fmt.Printf("Running saga order simulation with %d orders...\n", orderCount)
+
+	run := time.Now().Unix()
+	successCount := 0
+	failureCount := 0
+
+	for i := 0; i < orderCount; i++ {
+		req := OrderRequest{
+			OrderID:   fmt.Sprintf("ORDER-SAGA-%d-%04d", run, i+1),
+			UserName:  fmt.Sprintf("User%d", i+1),
+			UserEmail: fmt.Sprintf("user%d@example.com", i+1),
+			DeviceID:  fmt.Sprintf("DEVICE-%d", i+1),
+		}
+
+		status, err := postOrder(sagaOrderURL, req, "")
+		if err != nil || status != http.StatusAccepted {
+			slog.Error("saga order failed", "orderId", req.OrderID, "status", status, "error", err)
+			failureCount++
+		} else {
+			slog.Info("saga order accepted", "orderId", req.OrderID)
+			successCount++
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fmt.Printf("Saga simulation submitted. Accepted: %d, Failures: %d\n", successCount, failureCount)
+
+	var sagas []struct {
+		OrderID string `json:"orderId"`
+		Status  string `json:"status"`
+	}
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		var inFlight []json.RawMessage
+		if err := getJSON(sagasURL+"?status=RUNNING,COMPENSATING&limit=1", &inFlight); err == nil && len(inFlight) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			slog.Error("sagas did not settle in time, reporting their current state")
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err := getAll(sagasURL, &sagas); err != nil {
+		slog.Error("failed to fetch sagas", "error", err)
+		return false
+	}
+
+	messages, err := customerMessagesByOrder(sagaOrderID)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		slog.Error("failed to collect customer messages", "error", err)
+		return false
 	}
-	defer resp.Body.Close()
 
+	outcomes := make(map[string]int)
+	inconsistent := 0
+	for _, saga := range sagas {
+		if !strings.HasPrefix(saga.OrderID, fmt.Sprintf("ORDER-SAGA-%d-", run)) {
+			continue
+		}
+		outcomes[saga.Status]++
+
+		m := messages[saga.OrderID]
+		consistent := true
+		switch saga.Status {
+		case "COMPLETED":
+			consistent = m == customerMessages{completionEmails: 1, completionNotices: 1}
+		case "COMPENSATED":
+			consistent = m.completionEmails == m.apologyEmails && m.completionNotices == m.retractions
+		}
+		if !consistent {
+			slog.Error("customer messages do not match the saga outcome", "orderId", saga.OrderID, "status", saga.Status, "completionEmails", m.completionEmails, "apologyEmails", m.apologyEmails, "completionNotices", m.completionNotices, "retractions", m.retractions)
+			inconsistent++
+		}
+	}
+
+	fmt.Printf("Saga outcomes. Completed: %d, Compensated: %d, Still running: %d\n", outcomes["COMPLETED"], outcomes["COMPENSATED"], outcomes["RUNNING"]+outcomes["COMPENSATING"])
+	if inconsistent > 0 || outcomes["RUNNING"]+outcomes["COMPENSATING"] > 0 {
+		fmt.Printf("Saga simulation FAILED, %d order(s) left the customer with an inconsistent view\n", inconsistent)
+		return false
+	}
+	fmt.Println("Saga simulation passed. Every completed order was announced once and every compensated order was fully corrected")
+	return true
+}
+
+func runSMTPSimulation(emailCount int) bool {
+	fmt.Printf("Running SMTP delivery simulation with %d emails...\n", emailCount)
+
+	type smtpCheck struct {
+		id         int
+		status     string
+		recipients []string
+		delivered  []string
+	}
+
+	run := time.Now().Unix()
+	checks := make(map[string]*smtpCheck)
+	for i := 0; i < emailCount+2; i++ {
+		subject := fmt.Sprintf("SMTP-CHECK-%d-%04d", run, i+1)
+		user := fmt.Sprintf("user%d@example.com", i+1)
+		backup := fmt.Sprintf("backup%d@example.com", i+1)
+		check := &smtpCheck{status: "SENT", recipients: []string{user, fmt.Sprintf("User %d <%s>", i+1, backup)}, delivered: []string{user, backup}}
+		switch i {
+		case emailCount:
+			subject = fmt.Sprintf("SMTP-PARTIAL-%d", run)
+			check = &smtpCheck{status: "PARTIAL", recipients: []string{user, "not an address"}, delivered: []string{user}}
+		case emailCount + 1:
+			subject = fmt.Sprintf("SMTP-UNDELIVERABLE-%d", run)
+			check = &smtpCheck{status: "FAILED", recipients: []string{"not an address"}}
+		}
+
+		email := map[string]interface{}{
+			"recipients": check.recipients,
+			"subject":    subject,
+			"body":       "Plain text body of " + subject,
+		}
+		if i%2 == 0 {
+			email["htmlBody"] = "<p>HTML body of <b>" + subject + "</b></p>"
+		}
+		id, err := deliver(emailServiceURL, email, "MSG-"+subject)
+		if err != nil {
+			slog.Error("failed to store email", "subject", subject, "error", err)
+			return false
+		}
+		check.id = id
+		checks[subject] = check
+	}
+
+	type emailStatus struct {
+		Status     string `json:"status"`
+		Attempts   int    `json:"attempts"`
+		LastError  string `json:"last_error"`
+		Deliveries []struct {
+			Recipient string `json:"recipient"`
+			Status    string `json:"status"`
+			LastError string `json:"last_error"`
+		} `json:"deliveries"`
+	}
+	statuses := make(map[string]emailStatus)
+	pending := len(checks)
+	deadline := time.Now().Add(2 * time.Minute)
+	for pending > 0 && time.Now().Before(deadline) {
+		pending = 0
+		for subject, check := range checks {
+			var email emailStatus
+			if err := getJSON(fmt.Sprintf("%s/%d", emailsURL, check.id), &email); err != nil || email.Status == "PENDING" {
+				pending++
+				continue
+			}
+			statuses[subject] = email
+		}
+		if pending > 0 {
+			time.Sleep(time.Second)
+		}
+	}
+	if pending > 0 {
+		fmt.Printf("SMTP simulation FAILED, %d email(s) were still pending. Is email-worker running with EMAIL_SMTP_HOST set?\n", pending)
+		return false
+	}
+
+	violations := 0
+	for subject, check := range checks {
+		email := statuses[subject]
+		if email.Status != check.status || len(email.Deliveries) != len(check.recipients) {
+			slog.Error("email did not end in the expected status", "subject", subject, "expected", check.status, "status", email.Status, "deliveries", len(email.Deliveries), "attempts", email.Attempts, "lastError", email.LastError)
+			violations++
+			continue
+		}
+		for _, delivery := range email.Deliveries {
+			valid := !strings.Contains(delivery.Recipient, "not an address")
+			if valid && delivery.Status != "SENT" || !valid && (delivery.Status != "FAILED" || !strings.Contains(delivery.LastError, "invalid recipient")) {
+				slog.Error("email delivery did not end in the expected status", "subject", subject, "recipient", delivery.Recipient, "status", delivery.Status, "lastError", delivery.LastError)
+				violations++
+			}
+		}
+		if check.status != "SENT" && !strings.Contains(email.LastError, "invalid recipient") {
+			slog.Error("email does not report the failure reason of its delivery", "subject", subject, "status", email.Status, "lastError", email.LastError)
+			violations++
+		}
+	}
+
+	sinkDir := os.Getenv("SMTP_SINK_DIR")
+	if sinkDir == "" {
+		sinkDir = "./smtp_sink"
+	}
+	files, err := filepath.Glob(filepath.Join(sinkDir, "*.eml"))
+	if err != nil {
+		slog.Error("failed to list captured messages", "dir", sinkDir, "error", err)
+		return false
+	}
+
+	captured := make(map[string]int)
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			slog.Error("failed to read captured message", "path", file, "error", err)
+			violations++
+			continue
+		}
+		message, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			slog.Error("failed to parse captured message", "path", file, "error", err)
+			violations++
+			continue
+		}
+		subject := message.Header.Get("Subject")
+		if _, ok := checks[subject]; !ok {
+			continue
+		}
+
+		recipients, err := message.Header.AddressList("To")
+		if err != nil || len(recipients) != 1 {
+			slog.Error("captured message is not addressed to exactly one recipient", "path", file, "to", message.Header.Get("To"))
+			violations++
+			continue
+		}
+		captured[subject+" "+recipients[0].Address]++
+
+		if parts, err := alternativeParts(message); err != nil {
+			slog.Error("captured message is not a valid multipart/alternative message", "path", file, "error", err)
+			violations++
+		} else if !strings.Contains(parts["text/plain"], "Plain text body of "+subject) || !strings.Contains(parts["text/html"], subject) {
+			slog.Error("captured message is missing its plain-text or HTML body", "path", file, "parts", len(parts))
+			violations++
+		}
+	}
+
+	expected := 0
+	for subject, check := range checks {
+		for _, recipient := range check.delivered {
+			expected++
+			if captured[subject+" "+recipient] != 1 {
+				slog.Error("email was not captured exactly once for its recipient", "subject", subject, "recipient", recipient, "captured", captured[subject+" "+recipient])
+				violations++
+			}
+		}
+	}
+	total := 0
+	for _, count := range captured {
+		total += count
+	}
+	if total != expected {
+		slog.Error("the sink captured messages for recipients that should not have received one", "expected", expected, "captured", total)
+		violations++
+	}
+
+	if violations > 0 {
+		fmt.Printf("SMTP simulation FAILED with %d violation(s)\n", violations)
+		return false
+	}
+	fmt.Printf("SMTP simulation passed. %d emails were delivered to the sink once per recipient with plain-text and HTML bodies, and emails with invalid recipients ended PARTIAL and FAILED\n", emailCount)
+	return true
+}
+
+func alternativeParts(message *mail.Message) (map[string]string, error) {
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/alternative" {
+		return nil, fmt.Errorf("unexpected content type %s", mediaType)
+	}
+
+	parts := make(map[string]string)
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		parts[contentType] = string(body)
+	}
+}
+
+func runDuplicateSimulation(orderCount int) bool {
+	fmt.Printf("Running duplicate order simulation with %d orders...\n", orderCount)
+
+	run := time.Now().Unix()
+	violations := 0
+
+	for i := 0; i < orderCount; i++ {
+		req := OrderRequest{
+			OrderID:   fmt.Sprintf("ORDER-DUPLICATE-%d-%d", run, i+1),
+			UserName:  fmt.Sprintf("User%d", i+1),
+			UserEmail: fmt.Sprintf("user%d@example.com", i+1),
+			DeviceID:  fmt.Sprintf("DEVICE-%d", i+1),
+		}
+
+		if err := retryOrder(improvedOrderURL, req, req.OrderID); err != nil {
+			slog.Error("improved order failed", "orderId", req.OrderID, "error", err)
+			violations++
+			continue
+		}
+
+		statuses := make(chan int, 3)
+		var wg sync.WaitGroup
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, err := postOrder(improvedOrderURL, req, req.OrderID)
+				if err != nil {
+					slog.Error("failed to resend improved order", "orderId", req.OrderID, "error", err)
+				}
+				statuses <- status
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		for status := range statuses {
+			if status != http.StatusOK {
+				slog.Error("retry with the same idempotency key was not replayed", "orderId", req.OrderID, "status", status)
+				violations++
+			}
+		}
+
+		if status := answeredStatus(improvedOrderURL, req, ""); status != http.StatusConflict {
+			slog.Error("duplicate improved order without idempotency key was not rejected", "orderId", req.OrderID, "status", status)
+			violations++
+		}
+
+		if err := retryOrder(basicOrderURL, req, ""); err != nil {
+			slog.Error("basic order failed", "orderId", req.OrderID, "error", err)
+			violations++
+			continue
+		}
+		if status := answeredStatus(basicOrderURL, req, ""); status != http.StatusConflict {
+			slog.Error("duplicate basic order was not rejected", "orderId", req.OrderID, "status", status)
+			violations++
+		}
+
+		violations += expectCount("http://localhost:8083/orders?orderId="+req.OrderID, 1)
+		violations += expectCount("http://localhost:8083/outbox?orderId="+req.OrderID, 6)
+		violations += expectCount("http://localhost:8080/orders?orderId="+req.OrderID, 1)
+
+		email := map[string]interface{}{"recipients": []string{req.UserEmail}, "subject": "Order Redelivered", "body": "Redelivery of " + req.OrderID}
+		violations += expectSingleDelivery(emailServiceURL, email, "MSG-EMAIL-"+req.OrderID)
+		notification := map[string]interface{}{"deviceId": []string{req.DeviceID}, "message": "Redelivery of " + req.OrderID}
+		violations += expectSingleDelivery(notificationServiceURL, notification, "MSG-NOTIFY-"+req.OrderID)
+	}
+
+	if violations > 0 {
+		fmt.Printf("Duplicate simulation FAILED with %d violation(s)\n", violations)
+		return false
+	}
+	fmt.Printf("Duplicate simulation passed. %d orders were each retried and resubmitted without creating duplicate orders or outbox messages, and redelivered messages were stored once\n", orderCount)
+	return true
+}
+
+func runCancellationSimulation(orderCount int) bool {
+	fmt.Printf("Running cancellation simulation with %d orders...\n", orderCount)
+
+	run := time.Now().Unix()
+	violations := 0
+	var basicRolledBack, basicCancelled, improvedCancelled []string
+
+	for i := 0; i < orderCount; i++ {
+		req := OrderRequest{
+			OrderID:   fmt.Sprintf("ORDER-CANCEL-BASIC-%d-%04d", run, i+1),
+			UserName:  fmt.Sprintf("User%d", i+1),
+			UserEmail: fmt.Sprintf("user%d@example.com", i+1),
+			DeviceID:  fmt.Sprintf("DEVICE-%d", i+1),
+		}
+
+		if status, err := postOrder(basicOrderURL, req, ""); err != nil || status != http.StatusOK {
+			basicRolledBack = append(basicRolledBack, req.OrderID)
+		} else if status, err := post(basicOrdersURL+"/"+req.OrderID+"/cancel", nil, ""); err != nil || status != http.StatusOK {
+			slog.Error("basic order could not be cancelled", "orderId", req.OrderID, "status", status, "error", err)
+			violations++
+		} else {
+			basicCancelled = append(basicCancelled, req.OrderID)
+		}
+
+		req.OrderID = fmt.Sprintf("ORDER-CANCEL-IMPROVED-%d-%04d", run, i+1)
+		if err := retryOrder(improvedOrderURL, req, req.OrderID); err != nil {
+			slog.Error("improved order failed", "orderId", req.OrderID, "error", err)
+			violations++
+			continue
+		}
+		if status := answeredPost(improvedOrdersURL+"/"+req.OrderID+"/cancel", nil, req.OrderID+"-cancel"); status != http.StatusOK {
+			slog.Error("improved order could not be cancelled", "orderId", req.OrderID, "status", status)
+			violations++
+			continue
+		}
+		improvedCancelled = append(improvedCancelled, req.OrderID)
+	}
+
+	if !waitForOutbox(2 * time.Minute) {
+		slog.Error("outbox did not drain in time, counting what was delivered so far")
+		violations++
+	}
+
+	messages, err := customerMessagesByOrder(cancellationOrderID)
+	if err != nil {
+		slog.Error("failed to collect customer messages", "error", err)
+		return false
+	}
+
+	rolledBackButAnnounced := 0
+	for _, orderID := range basicRolledBack {
+		if m := messages[orderID]; m.completionEmails > 0 {
+			rolledBackButAnnounced++
+		}
+	}
+	cancelledButAnnounced := 0
+	for _, orderID := range basicCancelled {
+		if m := messages[orderID]; m.completionEmails > m.apologyEmails {
+			cancelledButAnnounced++
+		}
+	}
+	fmt.Printf("Basic (direct calls): %d cancelled, %d orders rolled back\n", len(basicCancelled), len(basicRolledBack))
+	fmt.Printf("  rolled back orders whose customer kept an \"Order Completed\" email: %d\n", rolledBackButAnnounced)
+	fmt.Printf("  cancelled orders whose customer was never told: %d\n", cancelledButAnnounced)
+
+	for _, orderID := range improvedCancelled {
+		m := messages[orderID]
+		if m != (customerMessages{completionEmails: 1, apologyEmails: 1, completionNotices: 1, retractions: 1}) {
+			slog.Error("cancelled improved order was not compensated exactly once", "orderId", orderID, "completionEmails", m.completionEmails, "apologyEmails", m.apologyEmails, "completionNotices", m.completionNotices, "retractions", m.retractions)
+			violations++
+		}
+	}
+	fmt.Printf("Improved (outbox): %d cancelled, each expected to get one apology email and one retraction\n", len(improvedCancelled))
+
+	if violations > 0 {
+		fmt.Printf("Cancellation simulation FAILED with %d violation(s)\n", violations)
+		return false
+	}
+	fmt.Println("Cancellation simulation passed. Every cancelled improved order was compensated exactly once")
+	return true
+}
+
+func waitForOutbox(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var pending []json.RawMessage
+		if err := getJSON(improvedOutboxURL+"?status=PENDING,PROCESSING&limit=1", &pending); err == nil && len(pending) == 0 {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+	return false
+}
+
+func customerMessagesByOrder(orderIDs *regexp.Regexp) (map[string]customerMessages, error) {
+	messages := make(map[string]customerMessages)
+
+	var emails []struct {
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}
+	if err := getAll(emailsURL, &emails); err != nil {
+		return nil, err
+	}
+	for _, email := range emails {
+		orderID := orderIDs.FindString(email.Body)
+		if orderID == "" {
+			continue
+		}
+		m := messages[orderID]
+		switch email.Subject {
+		case "Order Completed":
+			m.completionEmails++
+		case "Order Cancelled":
+			m.apologyEmails++
+		}
+		messages[orderID] = m
+	}
+
+	var notifications []struct {
+		Message string `json:"message"`
+	}
+	if err := getAll(notificationsURL, &notifications); err != nil {
+		return nil, err
+	}
+	for _, notification := range notifications {
+		orderID := orderIDs.FindString(notification.Message)
+		if orderID == "" {
+			continue
+		}
+		m := messages[orderID]
+		if strings.Contains(notification.Message, "was cancelled") {
+			m.retractions++
+		} else {
+			m.completionNotices++
+		}
+		messages[orderID] = m
+	}
+
+	return messages, nil
+}
+
+func getAll(url string, records interface{}) error {
+	var all []json.RawMessage
+	next := url + "?limit=1000"
+	for next != "" {
+		resp, err := http.Get(next)
+		if err != nil {
+			return err
+		}
+		var page []json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", next, err)
+		}
+		all = append(all, page...)
+
+		next = ""
+		if cursor := resp.Header.Get("X-Next-Cursor"); cursor != "" {
+			next = url + "?limit=1000&after=" + cursor
+		}
+	}
+
+	raw, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, records)
+}
+
+func getJSON(url string, value interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("service returned status: %d", resp.StatusCode)
+		return fmt.Errorf("%s returned status: %d", url, resp.StatusCode)
 	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
 
-	return nil
+func answeredPost(url string, body interface{}, idempotencyKey string) int {
+	var status int
+	for attempt := 0; attempt < 50; attempt++ {
+		status, _ = post(url, body, idempotencyKey)
+		if status != 0 && status < http.StatusInternalServerError {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return status
 }
 
-func sendImprovedOrder(req OrderRequest) error {
-	jsonData, _ := json.Marshal(req)
-	resp, err := http.Post("http://localhost:8083/finish-order-improved", "application/json", bytes.NewBuffer(jsonData))
+func answeredStatus(url string, req OrderRequest, idempotencyKey string) int {
+	return answeredPost(url, req, idempotencyKey)
+}
+
+func retryOrder(url string, req OrderRequest, idempotencyKey string) error {
+	var status int
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		status, err = postOrder(url, req, idempotencyKey)
+		if err == nil && status == http.StatusOK {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("service returned status: %d", status)
+}
+
+func expectSingleDelivery(serviceURL string, body interface{}, messageID string) int {
+	const deliveries = 4
+
+	ids := make(chan int, deliveries)
+	var wg sync.WaitGroup
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := deliver(serviceURL, body, messageID)
+			if err != nil {
+				slog.Error("failed to deliver message", "url", serviceURL, "messageId", messageID, "error", err)
+			}
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	violations := 0
+	first := 0
+	for id := range ids {
+		if first == 0 {
+			first = id
+		}
+		if id == 0 || id != first {
+			slog.Error("redelivered message was not acknowledged with the stored record", "url", serviceURL, "messageId", messageID, "id", id, "expected", first)
+			violations++
+		}
+	}
+
+	var inbox struct {
+		Deliveries int `json:"deliveries"`
+	}
+	if err := getJSON(serviceURL+"/inbox/"+messageID, &inbox); err != nil {
+		slog.Error("failed to read inbox", "url", serviceURL, "messageId", messageID, "error", err)
+		return violations + 1
+	}
+	if inbox.Deliveries != deliveries {
+		slog.Error("unexpected number of inbox deliveries", "url", serviceURL, "messageId", messageID, "expected", deliveries, "actual", inbox.Deliveries)
+		violations++
+	}
+	return violations
+}
+
+func deliver(serviceURL string, body interface{}, messageID string) (int, error) {
+	path := "/send-email"
+	if serviceURL == notificationServiceURL {
+		path = "/send-notification"
+	}
+	payload, _ := json.Marshal(body)
+
+	var lastErr error
+	for attempt := 0; attempt < 50; attempt++ {
+		httpReq, err := http.NewRequest(http.MethodPost, serviceURL+path, bytes.NewBuffer(payload))
+		if err != nil {
+			return 0, fmt.Errorf("failed to build request: %w", err)
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("X-Message-Id", messageID)
+
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			lastErr = err
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		var stored struct {
+			ID int `json:"id"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&stored)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && err == nil {
+			return stored.ID, nil
+		}
+		lastErr = fmt.Errorf("service returned status: %d", resp.StatusCode)
+		time.Sleep(50 * time.Millisecond)
+	}
+	return 0, lastErr
+}
+
+func expectCount(url string, expected int) int {
+	resp, err := http.Get(url)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		slog.Error("failed to verify records", "url", url, "error", err)
+		return 1
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("service returned status: %d", resp.StatusCode)
+	var records []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		slog.Error("failed to decode records", "url", url, "error", err)
+		return 1
+	}
+	if len(records) != expected {
+		slog.Error("unexpected number of records", "url", url, "expected", expected, "actual", len(records))
+		return 1
+	}
+	return 0
+}
+
+func postOrder(url string, req OrderRequest, idempotencyKey string) (int, error) {
+	return post(url, req, idempotencyKey)
+}
+
+func post(url string, body interface{}, idempotencyKey string) (int, error) {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %w", err)
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		httpReq.Header.Set("Idempotency-Key", idempotencyKey)
 	}
 
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func sendBasicOrder(req OrderRequest) error {
+	status, err := postOrder(basicOrderURL, req, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("service returned status: %d", status)
+	}
+	return nil
+}
+
+func sendImprovedOrder(req OrderRequest) error {
+	status, err := postOrder(improvedOrderURL, req, req.OrderID)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("service returned status: %d", status)
+	}
 	return nil
 }